@@ -1,121 +1,179 @@
 package main
 
+// Shows how to parse a command line made up of subcommands,
+// each with its own flags, like this, where foo is the name
+// of the executable:
+//
+//   foo init -sitename="My site" mysite
+//   foo build -output-dir=public news.md about.md
+//   foo build news.md -base-url=https://example.com/docs/
+//   foo -verbose serve
+//   foo serve -verbose
+//   foo new -- -dashes-.md
+//   foo help build
+//
+// Where:
+//   - Global flags, like -verbose, can go before or after the command.
+//   - A command's flags come after the command, mixed in with
+//     filenames in any order.
+//   - -- ends the flags. Everything after it is a filename,
+//     even if it starts with a dash.
+//   - help lists the commands. help followed by a command
+//     describes that command and its flags. So does -h
+//     after a command.
+//
+// The parsing is done by subcommands.go, which microcms uses
+// too, so build it along with this file:
+//
+//   go run cmdline.go subcommands.go build -output-dir=public news.md
+
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 )
+
 var (
 	// Initialize command-line flags.
 
-	// After the command line has been parsed, if "build" ocurreed
-	// on the command line then buildCmd.Parse() will be true, and
-	// of course false if there was no init command specified. 
+	// Global flags, allowed anywhere on the command line.
+	globalFlags = flag.NewFlagSet("foo", flag.ContinueOnError)
+	verbose     = globalFlags.Bool("verbose", false, "Describe what's happening")
+
 	// To see if the (optional) output dir has been specified,
 	// look for the value of that string, which is obtained
-	// using *buildOutputDir. It will be empty if not specified.
-	buildCmd = flag.NewFlagSet("build", flag.ExitOnError)
+	// using *buildOutputDir. It's "public" if not specified.
+	buildCmd       = flag.NewFlagSet("build", flag.ContinueOnError)
 	buildOutputDir = buildCmd.String("output-dir", "public", "Directory for generated HTML")
-	buildBaseURL = buildCmd.String("base-url", "", "Override URL specified in config")
+	buildBaseURL   = buildCmd.String("base-url", "", "Override URL specified in config")
 
 	// Init can take either of these forms:
 	// init
-	// init sitename=something
-	initCmd = flag.NewFlagSet("init", flag.ExitOnError)
+	// init -sitename=something
+	initCmd      = flag.NewFlagSet("init", flag.ContinueOnError)
 	initSiteName = initCmd.String("sitename", "", "Your site name")
 
+	serveCmd  = flag.NewFlagSet("serve", flag.ContinueOnError)
+	serveAddr = serveCmd.String("addr", "localhost:8080", "Address to listen on")
+
+	newCmd   = flag.NewFlagSet("new", flag.ContinueOnError)
+	newDraft = newCmd.Bool("draft", true, "Mark the new page as a draft")
+
+	cleanCmd = flag.NewFlagSet("clean", flag.ContinueOnError)
 )
 
-// Get commands, including subcommands with optional flags, and filenames off command line.
-// I do something gross here.
-// Options can take these forms, where foo is the name of the executable:
-// foo init filename1 filename2
-// foo init -sitename="My site"
-// foo init -sitename="My site"
-// foo build -output-dir=public init -sitename=fred foo bar build -base-url=htttps:://mypp.test.com test.md
-// foo filename -init
-//
-// Where:
-//   init has the optional arument -sitename=value
-//   init can be used by itself
-//   build has multiple arguments that can be placed anywhere on the command line
-//   filenames are anything leftover after the the rest 
-//   has been processed, and can appear anywhere.
-//
-// The gross thing is that the default case falls through when an argument
-// is being processed. Which means that while it works for filenames, in the
-// case of the command line "foo init -sitename=test news.md" it correctly
-// accepts news.cmd as a filename but also, incorrectly, -sitename=test. So  
-// I had to add the parsingArgument flag. When an argument is consumed
-// using Parse(os.Args[pos+1:]) then parsingArgument must be set manually to true.
-//
-func parseCmdLine() []string{
-	// Anything that wasn't command, argument, or option will be returned
-	// as a filename.
-	// Upon return:
-	//    if a command like init was encountered,
-	var filenames []string
-	var parsingArgument bool
-	for  pos, nextArg := range os.Args {
-		//fmt.Printf("\n\nTop of loop. os.Args[%v]: %v. parsingArgument: %v\n", pos, nextArg,parsingArgument)
-		switch nextArg {
-		case "init":
-			// initCmd.Parsed() is now true
-			initCmd.Parse(os.Args[pos+1:])
+// commands lists every command by name.
+// subcommands.go adds help.
+var commands = map[string]*command{
+	"init": {
+		args:    "[flags] [directory]",
+		summary: "Create a new site",
+		flags:   initCmd,
+		run: func(args []string) error {
+			fmt.Println("init")
 			if *initSiteName != "" {
-				// *initSitename now points to the string value.
-				// It's empty if -sitename  wasn't -sitename specified
-				parsingArgument = true
-			}
-		case "build":
-			buildCmd.Parse(os.Args[pos+1:])
-			if *buildOutputDir != "" {
-				parsingArgument = true
+				fmt.Println("-sitename: " + *initSiteName)
 			}
+			return showFiles(args)
+		},
+	},
+	"build": {
+		args:    "[flags] [filename...]",
+		summary: "Convert the site, or just the named files, to HTML",
+		flags:   buildCmd,
+		run: func(args []string) error {
+			fmt.Println("build")
+			fmt.Println("-output-dir: " + *buildOutputDir)
 			if *buildBaseURL != "" {
-				parsingArgument = true
+				fmt.Println("-base-url: " + *buildBaseURL)
 			}
-		default:
-			// If not in the middle of parsing a command-like subargument,
-			// like the -sitename=test in this command line:
-			//   foo init -sitename=test
-			// Where foo is the name of the program, and -sitename is
-			// an optional subcommand to init,
-			//
-			// os.Args[0] falls through so exclude it, since it's
-			// the name of the invoking program.
-			if !parsingArgument && pos > 0{
-				filenames =  append(filenames, nextArg)
-			} else {
-				parsingArgument = false
+			return showFiles(args)
+		},
+	},
+	"serve": {
+		args:    "[flags]",
+		summary: "Build the site and serve it, rebuilding as it changes",
+		flags:   serveCmd,
+		run: func(args []string) error {
+			if len(args) > 0 {
+				return fmt.Errorf("serve doesn't take filenames: %s", strings.Join(args, " "))
 			}
-
-		}
-	}
-	return filenames
+			fmt.Println("serve")
+			fmt.Println("-addr: " + *serveAddr)
+			return nil
+		},
+	},
+	"new": {
+		args:    "[flags] filename...",
+		summary: "Create new pages",
+		flags:   newCmd,
+		run: func(args []string) error {
+			if len(args) == 0 {
+				return errors.New("new needs at least one filename")
+			}
+			fmt.Println("new")
+			fmt.Printf("-draft: %v\n", *newDraft)
+			return showFiles(args)
+		},
+	},
+	"clean": {
+		args:    "",
+		summary: "Remove generated files",
+		flags:   cleanCmd,
+		run: func(args []string) error {
+			fmt.Println("clean")
+			return nil
+		},
+	},
 }
 
-func main() {
-	flag.Parse()
-	files := parseCmdLine()
-	if initCmd.Parsed() {
-		fmt.Println("init")
-		if *initSiteName != "" {
-			fmt.Println("--sitename: " + *initSiteName)
-		}
+// runCommandLine runs the command named on the command
+// line args, not including the program name.
+func runCommandLine(args []string) error {
+	// Global flags before the command. Parse stops at
+	// the command name, since it isn't a flag.
+	if err := globalFlags.Parse(args); err != nil {
+		return err
 	}
-	if buildCmd.Parsed() {
-		fmt.Println("build")
-		if *buildOutputDir != "" {
-			fmt.Println("--output-dir: " + *buildOutputDir)
-		}
-		if *buildBaseURL != "" {
-			fmt.Println("--base-url: " + *buildBaseURL)
-		}
+	args = globalFlags.Args()
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return errors.New("no command given")
+	}
+	name := args[0]
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q. Run \"%s help\" for a list", name, globalFlags.Name())
+	}
+	positional, err := parseArgs(cmd.flags, args[1:])
+	if err != nil {
+		return err
 	}
+	if *verbose {
+		fmt.Printf("Running %s with arguments %q\n", name, positional)
+	}
+	return cmd.run(positional)
+}
+
+// showFiles lists the filenames given to a command.
+func showFiles(files []string) error {
 	if len(files) > 0 {
 		fmt.Println(files)
 	} else {
 		fmt.Println("No files specified")
 	}
+	return nil
+}
+
+func main() {
+	if err := runCommandLine(os.Args[1:]); err != nil {
+		// -h and help have already been shown.
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 }
@@ -0,0 +1,394 @@
+// configcodec.go reads and writes config files in TOML, YAML or JSON
+// through one API. readConfig and writeConfig handle all three,
+// going by the file's extension or, if that doesn't say, what the
+// file looks like. Either can be used with a struct, using its toml,
+// yaml or json tags, or with a map.
+//
+// convertConfig turns a config file from one format into another.
+// Formats can't all say the same things: JSON has no dates and TOML
+// has no null, for example. So convertConfig reads back what it
+// wrote, and refuses to return it if anything changed, unless
+// it's told the conversion can be lossy.
+//
+// YAML is read with yaml.v3, which reads dates as dates and can
+// write 2.0 as a float, not an integer.
+//
+// There's no main function here. Build this file along with a
+// program that uses it, such as tomlgen.go, yamlreadwritestruct.go,
+// jsonstruct.go or microcmsnoyaml.go:
+//
+//	go run tomlgen.go configcodec.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	yamlv3 "gopkg.in/yaml.v3"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configFormat is the format of a config file.
+type configFormat string
+
+const (
+	formatTOML configFormat = "toml"
+	formatYAML configFormat = "yaml"
+	formatJSON configFormat = "json"
+)
+
+// Config file formats by extension
+var configFormats = map[string]configFormat{
+	".toml": formatTOML,
+	".yaml": formatYAML,
+	".yml":  formatYAML,
+	".json": formatJSON,
+}
+
+// parseConfigFormat returns the format named name, such as yaml.
+func parseConfigFormat(name string) (configFormat, error) {
+	if format, ok := configFormats["."+strings.ToLower(name)]; ok {
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown format %q. Use toml, yaml or json", name)
+}
+
+// formatOf returns the format of filename, whose contents are
+// data, from its extension. If it has some other extension,
+// it's the format data looks like.
+func formatOf(filename string, data []byte) (configFormat, error) {
+	if format, ok := configFormats[strings.ToLower(filepath.Ext(filename))]; ok {
+		return format, nil
+	}
+	if format, ok := sniffConfigFormat(data); ok {
+		return format, nil
+	}
+	return "", fmt.Errorf("%s: unable to tell whether it's TOML, YAML or JSON", filename)
+}
+
+// sniffConfigFormat guesses the format of data from its
+// first line that isn't blank or a comment.
+func sniffConfigFormat(data []byte) (configFormat, bool) {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		switch {
+		case len(line) == 0 || line[0] == '#':
+			continue
+		case line[0] == '{':
+			return formatJSON, true
+		case line[0] == '[' || tomlKeyValue.Match(line):
+			return formatTOML, true
+		case string(line) == "---" || yamlKeyValue.Match(line):
+			return formatYAML, true
+		}
+		return "", false
+	}
+	return "", false
+}
+
+var (
+	// key = value, with the key bare or quoted
+	tomlKeyValue = regexp.MustCompile(`^("[^"]*"|'[^']*'|[\w.-]+)\s*=`)
+	// key: value
+	yamlKeyValue = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s:#][^:#]*):(\s|$)`)
+)
+
+// readConfig reads the config file filename into v,
+// which is a pointer to a struct or a map.
+func readConfig(filename string, v interface{}) (configFormat, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	format, err := formatOf(filename, data)
+	if err != nil {
+		return "", err
+	}
+	if err := decodeConfig(data, format, v); err != nil {
+		return "", fmt.Errorf("%s: %w", filename, err)
+	}
+	return format, nil
+}
+
+// writeConfig writes v, a struct or a map, to the config file
+// filename in the format its extension calls for.
+func writeConfig(filename string, v interface{}) error {
+	format, ok := configFormats[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		return fmt.Errorf("%s: unknown config file extension. Use .toml, .yaml or .json", filename)
+	}
+	data, err := encodeConfig(v, format)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+// decodeConfig decodes data, in the given format, into v. A map
+// gets the same types whatever the format: tables are
+// map[string]interface{}, lists are []interface{}, whole numbers
+// are int64 and other numbers are float64.
+func decodeConfig(data []byte, format configFormat, v interface{}) (err error) {
+	switch format {
+	case formatTOML:
+		_, err = toml.Decode(string(data), v)
+	case formatYAML:
+		err = yamlv3.Unmarshal(data, v)
+	case formatJSON:
+		d := json.NewDecoder(bytes.NewReader(data))
+		// Otherwise every number is a float64.
+		d.UseNumber()
+		err = d.Decode(v)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	if m, ok := v.(*map[string]interface{}); ok {
+		for key, value := range *m {
+			(*m)[key] = normalizeConfig(value)
+		}
+	}
+	return nil
+}
+
+// normalizeConfig returns value, decoded from any format, using
+// the types decodeConfig promises.
+func normalizeConfig(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeConfig(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalizeConfig(item)
+		}
+		return m
+	case []map[string]interface{}:
+		// TOML arrays of tables
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = normalizeConfig(item)
+		}
+		return list
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeConfig(item)
+		}
+		return v
+	case int:
+		return int64(v)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	}
+	return value
+}
+
+// encodeConfig returns v, a struct or a map, in the given format.
+func encodeConfig(v interface{}, format configFormat) ([]byte, error) {
+	var b bytes.Buffer
+	switch format {
+	case formatTOML:
+		if err := toml.NewEncoder(&b).Encode(v); err != nil {
+			return nil, err
+		}
+	case formatYAML:
+		e := yamlv3.NewEncoder(&b)
+		e.SetIndent(2)
+		if err := e.Encode(exactFloats(v, format)); err != nil {
+			return nil, err
+		}
+		if err := e.Close(); err != nil {
+			return nil, err
+		}
+	case formatJSON:
+		e := json.NewEncoder(&b)
+		e.SetIndent("", "  ")
+		if err := e.Encode(exactFloats(v, format)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return b.Bytes(), nil
+}
+
+// exactFloats returns value with every float64 that's a whole
+// number, like 2.0, written so it's read back as a float. YAML
+// and JSON would otherwise write 2, which reads as an integer.
+func exactFloats(value interface{}, format configFormat) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = exactFloats(item, format)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = exactFloats(item, format)
+		}
+		return list
+	case float64:
+		if v != math.Trunc(v) || math.IsInf(v, 0) {
+			return v
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		if format == formatJSON {
+			return json.RawMessage(s)
+		}
+		return &yamlv3.Node{Kind: yamlv3.ScalarNode, Value: s}
+	}
+	return value
+}
+
+// convertConfig returns data, a config file in the format from,
+// in the format to. Unless lossy is true, it's an error if the
+// result doesn't read back exactly as data does.
+func convertConfig(data []byte, from, to configFormat, lossy bool) ([]byte, error) {
+	settings := make(map[string]interface{})
+	if err := decodeConfig(data, from, &settings); err != nil {
+		return nil, err
+	}
+	converted, err := encodeConfig(settings, to)
+	if err != nil {
+		return nil, err
+	}
+	if lossy {
+		return converted, nil
+	}
+	check := make(map[string]interface{})
+	if err := decodeConfig(converted, to, &check); err != nil {
+		return nil, err
+	}
+	if diff := configDiff("", settings, check); diff != "" {
+		return nil, fmt.Errorf("%s can't say the same thing: %s. Use -lossy to convert anyway", strings.ToUpper(string(to)), diff)
+	}
+	return converted, nil
+}
+
+// configDiff describes the first difference between two config
+// values, want and got, that were decoded by decodeConfig. It
+// returns "" if they're the same. key is the key of want.
+func configDiff(key string, want, got interface{}) string {
+	name := func(k string) string {
+		if key == "" {
+			return k
+		}
+		return key + "." + k
+	}
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(w))
+		for k := range w {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			item, ok := g[k]
+			if !ok {
+				return fmt.Sprintf("%s would be left out", name(k))
+			}
+			if diff := configDiff(name(k), w[k], item); diff != "" {
+				return diff
+			}
+		}
+		for k := range g {
+			if _, ok := w[k]; !ok {
+				return fmt.Sprintf("%s would be added", name(k))
+			}
+		}
+		return ""
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			break
+		}
+		for i := range w {
+			if diff := configDiff(fmt.Sprintf("%s[%d]", key, i), w[i], g[i]); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	case time.Time:
+		// TOML has dates and times with no time zone, which YAML
+		// doesn't. Go gives them time zones of their own.
+		if g, ok := got.(time.Time); ok && w.Equal(g) {
+			_, wantOffset := w.Zone()
+			_, gotOffset := g.Zone()
+			if wantOffset == gotOffset && localTime(w) == localTime(g) {
+				return ""
+			}
+		}
+	default:
+		if reflect.DeepEqual(want, got) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%s would change from %s to %s", key, describeConfigValue(want), describeConfigValue(got))
+}
+
+// localTime returns true if t is one of TOML's dates
+// or times without a time zone.
+func localTime(t time.Time) bool {
+	return strings.HasSuffix(t.Location().String(), "-local")
+}
+
+// describeConfigValue returns value's type and value for an
+// error message, like the string "dark".
+func describeConfigValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("the string %q", v)
+	case int64:
+		return fmt.Sprintf("the integer %d", v)
+	case float64:
+		return fmt.Sprintf("the float %v", v)
+	case bool:
+		return fmt.Sprintf("%v", v)
+	case time.Time:
+		switch v.Location().String() {
+		case "date-local":
+			return "the local date " + v.Format("2006-01-02")
+		case "datetime-local":
+			return "the local date and time " + v.Format("2006-01-02T15:04:05.999999999")
+		case "time-local":
+			return "the local time " + v.Format("15:04:05.999999999")
+		}
+		return "the date and time " + v.Format(time.RFC3339Nano)
+	case map[string]interface{}:
+		return "a table"
+	case []interface{}:
+		return "a list"
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -35,7 +35,9 @@ import (
 	"github.com/radovskyb/watcher"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 )
 
@@ -134,7 +136,9 @@ func main() {
 			case event := <-w.Event:
 				fmt.Println(event)
 			case err := <-w.Error:
-				panic(err)
+				// Report the problem and keep watching. For example,
+				// deleting WWW itself causes ErrWatchedFileDeleted.
+				fmt.Println("Error:", err)
 			case <-w.Closed:
 				return
 			}
@@ -157,13 +161,22 @@ func main() {
 		}
 	}
 
+	// Ctrl+C closes the watcher, which makes Start return,
+	// instead of killing the program partway through.
+	// w.Wait() blocks until Start is running. Close does
+	// nothing before then, so on its own in a goroutine
+	// Wait isn't needed, but before Close it is.
 	go func() {
-		// TC: Not sure why this is necessary
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
 		w.Wait()
+		w.Close()
 	}()
 
 	// Start the watching process - it'll check for changes every 100ms.
 	if err := w.Start(time.Millisecond * 100); err != nil {
 		log.Fatalln(err)
 	}
+	fmt.Println("Stopped watching")
 }
@@ -36,7 +36,9 @@ import (
 	"github.com/radovskyb/watcher"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 )
 
@@ -152,13 +154,19 @@ func main() {
 		}
 	}
 
+	// Closed once the watcher has been closed and
+	// nothing more will arrive on its channels.
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		for {
 			select {
 			case event := <-w.Event:
 				fmt.Println(event)
 			case err := <-w.Error:
-				panic(err)
+				// Report the problem and keep watching. For example,
+				// deleting WWW itself causes ErrWatchedFileDeleted.
+				fmt.Println("Error:", err)
 			case <-w.Closed:
 				return
 			}
@@ -166,13 +174,24 @@ func main() {
 	}()
 
 	// Start the watching process - it'll check for changes every 100ms.
-	if err := w.Start(time.Millisecond * 100); err != nil {
-		log.Fatalln(err)
-	}
-
+	// Start doesn't return until the watcher is closed, so it runs in
+	// its own goroutine, leaving main free to wait for Ctrl+C.
 	go func() {
-		// TC: Not sure why this is necessary
-		w.Wait()
+		if err := w.Start(time.Millisecond * 100); err != nil {
+			log.Fatalln(err)
+		}
 	}()
 
+	// This is why Wait is necessary: it blocks until
+	// Start is running. Closing the watcher before
+	// then would do nothing.
+	w.Wait()
+	fmt.Println("Watching. Press Ctrl+C to stop")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	w.Close()
+	<-done
+	fmt.Println("Stopped watching")
 }
@@ -13,10 +13,12 @@ import (
 	"os"
 	"flag"
 	"bytes"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark-highlighting"
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
 	"github.com/yuin/goldmark/renderer/html"
 )
 
@@ -25,6 +27,13 @@ type markdownOptions struct {
 	// Name of color scheme used for code highlighting,
 	// for example, "monokai"
 	highlightStyle string
+	// Number the lines of highlighted code
+	lineNumbers bool
+	// Turn every line break in a paragraph into <br />
+	hardWraps bool
+	// Mark highlighted code with CSS classes, for a
+	// stylesheet to color, instead of inline styles
+	classes bool
 }
 
 // Compound data structure for config example at
@@ -36,8 +45,12 @@ type Env struct {
 func main() {
 	// Obtain command-line options
 	// Filenames are left in flag.Args()
+	var options markdownOptions
+	flag.StringVar(&options.highlightStyle, "highlight", "monokai", "color theme for code highlighting, or \"\" for none")
+	flag.BoolVar(&options.lineNumbers, "line-numbers", false, "number the lines of highlighted code")
+	flag.BoolVar(&options.hardWraps, "hard-wraps", false, "turn line breaks in paragraphs into <br />")
+	flag.BoolVar(&options.classes, "classes", false, "mark highlighted code with CSS classes instead of colors")
 	flag.Parse()
-	//pHighlightStyle := flag.String("highlight", "monokai", "color theme for code highlighting")
 	if len(flag.Args()) < 1 {
 		quit("Please specify a Markdown file", 1)
 	}
@@ -52,30 +65,35 @@ func main() {
 		// TODO: More specific error handling
 		quit(err.Error(), 1)
 	}
-	fmt.Println(string(mdFileToHTML(filename, input)))
+	fmt.Println(string(mdFileToHTML(filename, input, &options)))
 
 }
 
 
-func mdFileToHTML(filename string, input []byte) []byte {
+func mdFileToHTML(filename string, input []byte, options *markdownOptions) []byte {
 	// Resolve any Go template variables before conversion to HTML.
 	//interp := interps(filename, string(input))
 
+	exts := []goldmark.Extender{extension.GFM, extension.DefinitionList}
+	if options.highlightStyle != "" {
+		exts = append(exts, highlighting.NewHighlighting(
+			highlighting.WithStyle(options.highlightStyle),
+			highlighting.WithFormatOptions(
+				chromahtml.WithLineNumbers(options.lineNumbers),
+				chromahtml.WithClasses(options.classes),
+			),
+		))
+	}
+	renderOpts := []renderer.Option{html.WithXHTML()}
+	if options.hardWraps {
+		renderOpts = append(renderOpts, html.WithHardWraps())
+	}
 	markdown := goldmark.New(
-		goldmark.WithExtensions(extension.GFM, extension.DefinitionList,
-			highlighting.NewHighlighting(
-				highlighting.WithStyle("monokai"),
-				highlighting.WithFormatOptions(
-				//highlighting.WithLineNumbers(),
-				),
-			)),
+		goldmark.WithExtensions(exts...),
 		goldmark.WithParserOptions(
 			parser.WithAutoHeadingID(),
 		),
-		goldmark.WithRendererOptions(
-			/* html.WithHardWraps(), */
-			html.WithXHTML(),
-		),
+		goldmark.WithRendererOptions(renderOpts...),
 	)
 
 	var buf bytes.Buffer
@@ -1,13 +1,13 @@
 // Shows how to initialize nested struct in golang, write to JSON file,
 // and read back from JSON file. Uses the real-life example
-// of an OAuth2 Config struct.
+// of an OAuth2 Config struct. The file is written and read
+// by configcodec.go, so run it like this:
+//   go run jsonstruct.go configcodec.go
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"golang.org/x/oauth2"
-	"io/ioutil"
 	"os"
 )
 
@@ -27,27 +27,16 @@ func main() {
 	// Display its contents.
 	fmt.Fprintf(os.Stdout, "Config object before marshaling:\n%+v\n\n", c)
 
-	// Convert it to a JSON-encoded blob (byte array).
-	b, err := json.Marshal(c)
+	// Write it to a file. The .json extension says
+	// to convert it to JSON.
+	err := writeConfig("sample.json", c)
 	if err != nil {
 		panic(err)
 	}
 
-	// Write it to a file.
-	err = ioutil.WriteFile("sample.json", b, 0644)
-	if err != nil {
-		panic(err)
-	}
-
-	// Read the file back into another byte array.
-	b2, err := ioutil.ReadFile("sample.json")
-	if err != nil {
-		panic(err)
-	}
-
-	// Convert the JSON-encoded blob into an oauth2.Config struct
+	// Read the file back into an oauth2.Config struct
 	var c2 oauth2.Config
-	err = json.Unmarshal(b2, &c2)
+	_, err = readConfig("sample.json", &c2)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,257 @@
+// markdownpipeline.go sets up goldmark from a set of options,
+// and lists a converted document's headings as a table of
+// contents. markdownOptions says which extensions and options
+// to use. Its config tags name them, as they're written in a
+// config file's [markdown] table or a page's markdown front
+// matter, and its with method changes options by those names.
+//
+// Every option is off by default, which is goldmark's CommonMark
+// with nothing added. table, strikethrough, linkify and task-list
+// together are GitHub Flavored Markdown.
+//
+// There's no main function here. Build this file along with a
+// program that uses it, such as microcmsnoyaml.go or
+// mdcodeyamltemplate.go:
+//
+//	go run mdcodeyamltemplate.go markdownpipeline.go
+package main
+
+import (
+	"fmt"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark-highlighting"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"html"
+	"reflect"
+	"strings"
+)
+
+// markdownOptions controls how Markdown is converted. The config
+// tag names each option, as a setting in the markdown group.
+type markdownOptions struct {
+	Table          bool   `config:"table" usage:"Convert GitHub tables"`
+	Strikethrough  bool   `config:"strikethrough" usage:"Convert ~~strikethrough~~"`
+	Linkify        bool   `config:"linkify" usage:"Turn URLs in the text into links"`
+	TaskList       bool   `config:"task-list" usage:"Convert task lists such as - [x] done"`
+	DefinitionList bool   `config:"definition-list" usage:"Convert PHP Markdown Extra definition lists"`
+	Footnote       bool   `config:"footnote" usage:"Convert PHP Markdown Extra footnotes"`
+	Typographer    bool   `config:"typographer" usage:"Replace straight quotes, -- and ... with typographic ones"`
+	HardWraps      bool   `config:"hard-wraps" usage:"Turn every line break in a paragraph into <br>"`
+	XHTML          bool   `config:"xhtml" usage:"Write XHTML, such as <br />, instead of HTML"`
+	Unsafe         bool   `config:"unsafe" usage:"Keep raw HTML and javascript: links instead of leaving them out"`
+	Attributes     bool   `config:"attributes" usage:"Allow attributes such as {#id .class} after headings"`
+	AutoHeadingIDs bool   `config:"auto-heading-ids" usage:"Give each heading an id made from its text"`
+	HighlightStyle string `config:"highlight-style" usage:"Chroma style for highlighting code blocks, such as github or monokai (default: none)"`
+	LineNumbers    bool   `config:"line-numbers" usage:"Number the lines of highlighted code blocks"`
+	// Classes keep the colors out of every page, and let
+	// a stylesheet choose them. microcms highlight-css
+	// writes one.
+	HighlightClasses   bool   `config:"highlight-classes" usage:"Mark highlighted code with CSS classes instead of colors. Use highlight-css to write the stylesheet"`
+	HighlightDarkStyle string `config:"highlight-dark-style" usage:"Chroma style highlight-css uses when the browser prefers a dark color scheme (default: none)"`
+}
+
+// check returns an error if the options can't be used.
+func (o markdownOptions) check() error {
+	for _, style := range []string{o.HighlightStyle, o.HighlightDarkStyle} {
+		if _, ok := styles.Registry[style]; style != "" && !ok {
+			return fmt.Errorf("unknown highlight style %q. Try one of: %s",
+				style, strings.Join(styles.Names(), " "))
+		}
+	}
+	return nil
+}
+
+// with returns the options changed by overrides, whose keys
+// are the names in markdownOptions' config tags, such as the
+// markdown table from a page's front matter.
+func (o markdownOptions) with(overrides map[string]interface{}) (markdownOptions, error) {
+	v := reflect.ValueOf(&o).Elem()
+	for key, value := range overrides {
+		field, ok := markdownOption(v.Type(), key)
+		if !ok {
+			return o, fmt.Errorf("unknown option %q", key)
+		}
+		f := v.FieldByIndex(field.Index)
+		switch f.Kind() {
+		case reflect.Bool:
+			b, ok := value.(bool)
+			if !ok {
+				return o, fmt.Errorf("%s should be true or false, not %v", key, value)
+			}
+			f.SetBool(b)
+		case reflect.String:
+			s, ok := value.(string)
+			if !ok {
+				return o, fmt.Errorf("%s should be a string, not %v", key, value)
+			}
+			f.SetString(s)
+		}
+	}
+	return o, o.check()
+}
+
+// markdownOption returns the field of markdownOptions, whose
+// type is t, for the option name.
+func markdownOption(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(t.Field(i).Tag.Get("config"), name) {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// newMarkdown returns a goldmark converter that uses options.
+// Any extra goldmark options are applied after them.
+func newMarkdown(options markdownOptions, extra ...goldmark.Option) goldmark.Markdown {
+	var exts []goldmark.Extender
+	for _, ext := range []struct {
+		on       bool
+		extender goldmark.Extender
+	}{
+		{options.Table, extension.Table},
+		{options.Strikethrough, extension.Strikethrough},
+		{options.Linkify, extension.Linkify},
+		{options.TaskList, extension.TaskList},
+		{options.DefinitionList, extension.DefinitionList},
+		{options.Footnote, extension.Footnote},
+		{options.Typographer, extension.Typographer},
+	} {
+		if ext.on {
+			exts = append(exts, ext.extender)
+		}
+	}
+	if options.HighlightStyle != "" {
+		exts = append(exts, highlighting.NewHighlighting(
+			highlighting.WithStyle(options.HighlightStyle),
+			highlighting.WithFormatOptions(
+				chromahtml.WithLineNumbers(options.LineNumbers),
+				chromahtml.WithClasses(options.HighlightClasses))))
+	}
+	var parserOpts []parser.Option
+	if options.Attributes {
+		parserOpts = append(parserOpts, parser.WithAttribute())
+	}
+	if options.AutoHeadingIDs {
+		parserOpts = append(parserOpts, parser.WithAutoHeadingID())
+	}
+	var renderOpts []renderer.Option
+	if options.HardWraps {
+		renderOpts = append(renderOpts, gmhtml.WithHardWraps())
+	}
+	if options.XHTML {
+		renderOpts = append(renderOpts, gmhtml.WithXHTML())
+	}
+	if options.Unsafe {
+		renderOpts = append(renderOpts, gmhtml.WithUnsafe())
+	}
+	opts := []goldmark.Option{
+		goldmark.WithExtensions(exts...),
+		goldmark.WithParserOptions(parserOpts...),
+		goldmark.WithRendererOptions(renderOpts...),
+	}
+	return goldmark.New(append(opts, extra...)...)
+}
+
+// Heading is a heading in a document.
+type Heading struct {
+	// 1 for <h1> through 6 for <h6>
+	Level int
+	// The heading's id attribute. It's empty unless the heading
+	// has attributes or the auto-heading-ids option is set.
+	ID string
+	// The heading with any Markdown formatting removed
+	Text string
+}
+
+// documentHeadings returns every heading in the document whose
+// parsed form is root and whose Markdown is source.
+func documentHeadings(root ast.Node, source []byte) (headings []Heading) {
+	ast.Walk(root, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		node, ok := n.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		h := Heading{Level: node.Level, Text: headingText(node, source)}
+		if id, ok := node.AttributeString("id"); ok {
+			if b, ok := id.([]byte); ok {
+				h.ID = string(b)
+			}
+		}
+		headings = append(headings, h)
+		return ast.WalkSkipChildren, nil
+	})
+	return headings
+}
+
+// headingText returns the text of node, a heading,
+// with any Markdown formatting removed.
+func headingText(node ast.Node, source []byte) string {
+	var b strings.Builder
+	ast.Walk(node, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch t := n.(type) {
+		case *ast.Text:
+			b.Write(t.Segment.Value(source))
+			if t.SoftLineBreak() || t.HardLineBreak() {
+				b.WriteByte(' ')
+			}
+		case *ast.String:
+			b.Write(t.Value)
+		}
+		return ast.WalkContinue, nil
+	})
+	return strings.TrimSpace(b.String())
+}
+
+// Levels of heading in a table of contents
+// unless the page says otherwise
+const (
+	defaultTOCMin = 2
+	defaultTOCMax = 3
+)
+
+// tocHTML returns the headings from level min to max as nested
+// lists, each linking to its heading. A heading that's deeper
+// than the one before it starts a new list inside that one's item.
+// Headings without an id are listed without links.
+func tocHTML(headings []Heading, min, max int) string {
+	var b strings.Builder
+	// Levels of the lists that are open, outermost first
+	var open []int
+	for _, h := range headings {
+		if h.Level < min || h.Level > max {
+			continue
+		}
+		for len(open) > 1 && h.Level < open[len(open)-1] {
+			b.WriteString("</li>\n</ul>\n")
+			open = open[:len(open)-1]
+		}
+		if len(open) == 0 || h.Level > open[len(open)-1] {
+			if len(open) > 0 {
+				b.WriteString("\n")
+			}
+			b.WriteString("<ul>\n")
+			open = append(open, h.Level)
+		} else {
+			b.WriteString("</li>\n")
+		}
+		if h.ID == "" {
+			fmt.Fprintf(&b, "<li>%s", html.EscapeString(h.Text))
+		} else {
+			fmt.Fprintf(&b, "<li><a href=\"#%s\">%s</a>", html.EscapeString(h.ID), html.EscapeString(h.Text))
+		}
+	}
+	for range open {
+		b.WriteString("</li>\n</ul>\n")
+	}
+	return b.String()
+}
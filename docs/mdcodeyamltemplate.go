@@ -3,32 +3,56 @@
 // Demonstrates
 // 1. The goldmark Markdown to HTML converter using an App object
 // 2. Code highlighting.
-// 3. Extracting YAML front matter
+// 3. Extracting front matter in YAML, TOML, or JSON format
+//    and checking it against a schema
 // 4. Executing a template to interpolate front matter metadata with its evaluated result
 // 5. Adding a custom template function
+// 6. Converting documents in several goroutines with one App.
+//    Convert returns a Document with the HTML, front matter,
+//    headings, table of contents and any warnings.
+// 7. Choosing goldmark's extensions and options in a project
+//    config file, and changing them for a page in its front matter
+// 8. A table of contents, from {{ toc }} or toc: true in front matter,
+//    and the headings as .Page.Headings
+// 9. Executing templates before or after converting the Markdown,
+//    set by order in the config's [templates] table, without
+//    touching {{ }} in code or raw HTML
+
+// It needs markdownpipeline.go, from the directory this file is
+// in, which sets up goldmark and builds the table of contents.
+// Copy it into ~/g too.
 
 // $ mkdir ~/g
 // $ cd ~/g
 // $ go mod init example.com/g # example.com is OK to use in this quick & dirty example
 // $ go fmt
 // $ go mod tidy
-// $ go run g.go
-// $ go run g.go > foobar.html
+// $ go run g.go markdownpipeline.go
+// $ go run g.go markdownpipeline.go > foobar.html
 // $ open foobar.html
 
 package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"github.com/BurntSushi/toml"
 	"github.com/yuin/goldmark"
-	"github.com/yuin/goldmark-highlighting"
 	"github.com/yuin/goldmark-meta"
-	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/parser"
 	"github.com/yuin/goldmark/renderer"
-	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"gopkg.in/yaml.v3"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -48,6 +72,26 @@ Tags:
 ---
 `
 
+// Same front matter as above, but in TOML, Hugo style
+const tomlFrontMatter = `+++
+Title = "goldmark-meta"
+Month = "January"
+Theme = "wide"
+Summary = "Add TOML metadata to the document"
+Tags = ["markdown", "goldmark"]
++++
+`
+
+// And again in JSON
+const jsonFrontMatter = `{
+  "Title": "goldmark-meta",
+  "Month": "January",
+  "Theme": "wide",
+  "Summary": "Add JSON metadata to the document",
+  "Tags": ["markdown", "goldmark"]
+}
+`
+
 const codeFence = "\nhello, world.\n\n### Code fence with highlighting:\n" +
 	"Code fence example:\n" +
 	"```js\n" +
@@ -62,12 +106,33 @@ The Month is: {{ ftime .Month }}
 Fully formatted date: {{ ftime }}
 `
 
+// .Page is the Document being converted
+const tocExample = `
+## Table of contents test
+This document has {{ len .Page.Headings }} headings.
+`
+
+// App converts Markdown documents. Once its page types and schemas
+// are registered, one App can convert documents in any number of
+// goroutines at once. Everything about a single document is in the
+// Document that Convert returns, not in the App.
 type App struct {
-	mdParser    goldmark.Markdown
-	mdParserCtx parser.Context
+	// Converts every document whose front matter
+	// doesn't change options
+	mdParser goldmark.Markdown
+	options  markdownOptions
 
-	// YAML front matter
-	metaData map[string]interface{}
+	// Converters for other options, made the first
+	// time a document asks for them
+	mu         sync.Mutex
+	converters map[markdownOptions]goldmark.Markdown
+
+	// Whether Render executes templates before or
+	// after converting the Markdown
+	order templateOrder
+
+	// Front matter schemas by content section. See registerPageType.
+	schemas map[string]*frontMatterSchema
 
 	// All built-in functions must appear here to be publicly available
 	funcs map[string]interface{}
@@ -87,48 +152,91 @@ func (app *App) addTemplateFunctions() {
 		   "inc":      a.inc,
 		   "path":     a.path,
 		   "scode":    a.scode,
-		   "toc":      a.toc,
 		*/
+		// toc is added for each document. See Document.funcs.
 	}
 }
 
-// newGoldmark returns the a goldmark object with a parser and renderer.
-func (app *App) newGoldmark() goldmark.Markdown {
-	exts := []goldmark.Extender{
-		meta.New(
-			meta.WithStoresInDocument(),
-		),
-		// Support GitHub tables & other extensions
-		extension.Table,
-		extension.GFM,
-		extension.DefinitionList,
-		extension.Footnote,
-		highlighting.NewHighlighting(
-			highlighting.WithStyle("github"),
-			highlighting.WithFormatOptions()),
+// defaultMarkdownOptions returns the options an App starts with:
+// GitHub Flavored Markdown plus definition lists and footnotes,
+// code highlighted in the github style, and raw HTML allowed.
+func defaultMarkdownOptions() markdownOptions {
+	return markdownOptions{
+		Table:          true,
+		Strikethrough:  true,
+		Linkify:        true,
+		TaskList:       true,
+		DefinitionList: true,
+		Footnote:       true,
+		XHTML:          true,
+		Unsafe:         true,
+		Attributes:     true,
+		AutoHeadingIDs: true,
+		HighlightStyle: "github",
 	}
+}
 
-	parserOpts := []parser.Option{
-		parser.WithAttribute(),
-		parser.WithAutoHeadingID()}
+// newGoldmark returns a goldmark object that uses options,
+// reads YAML front matter, and stands in for code while
+// Render executes templates.
+func (app *App) newGoldmark(options markdownOptions) goldmark.Markdown {
+	return newMarkdown(options,
+		goldmark.WithExtensions(meta.New(meta.WithStoresInDocument())),
+		goldmark.WithRendererOptions(renderer.WithNodeRenderers(util.Prioritized(protectedRenderer{}, 100))))
+}
 
-	renderOpts := []renderer.Option{
-		// WithUnsafe is required for HTML templates to work properly
-		html.WithUnsafe(),
-		html.WithXHTML(),
+// configure changes the options every document is converted
+// with to those in the [markdown] table of config, a project
+// config file in TOML. Options it doesn't mention are unchanged.
+// The order in its [templates] table is the order Render uses,
+// "markdown-first" or "template-first".
+// It must be called before any documents are converted.
+func (app *App) configure(config string) error {
+	var project struct {
+		Markdown  map[string]interface{}
+		Templates struct {
+			Order string
+		}
+	}
+	if _, err := toml.Decode(config, &project); err != nil {
+		return err
+	}
+	options, err := app.options.with(normalizeMetaData(project.Markdown))
+	if err != nil {
+		return fmt.Errorf("markdown: %w", err)
+	}
+	if project.Templates.Order != "" {
+		if app.order, err = parseTemplateOrder(project.Templates.Order); err != nil {
+			return err
+		}
 	}
-	return goldmark.New(
-		goldmark.WithExtensions(exts...),
-		goldmark.WithParserOptions(parserOpts...),
-		goldmark.WithRendererOptions(renderOpts...),
-	)
+	app.options = options
+	app.mdParser = app.newGoldmark(options)
+	return nil
+}
+
+// converter returns the goldmark object for options.
+func (app *App) converter(options markdownOptions) goldmark.Markdown {
+	if options == app.options {
+		return app.mdParser
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	md, ok := app.converters[options]
+	if !ok {
+		md = app.newGoldmark(options)
+		app.converters[options] = md
+	}
+	return md
 }
 
 func NewApp() *App {
 	app := App{}
 
-	app.mdParser = app.newGoldmark()
-	app.mdParserCtx = parser.NewContext()
+	app.options = defaultMarkdownOptions()
+	app.mdParser = app.newGoldmark(app.options)
+	app.converters = make(map[markdownOptions]goldmark.Markdown)
+	app.schemas = make(map[string]*frontMatterSchema)
 	app.addTemplateFunctions()
 	return &app
 }
@@ -143,104 +251,1158 @@ func mdTest() {
 		quit(err, 1)
 	} else {
 		fmt.Println(string(b))
-		fmt.Printf("Front matter as YAML: %v\n", app.metaData)
 	}
 }
 func mdYAMLTest() {
 	var app = NewApp()
-	if b, err := app.mdYAMLToHTML([]byte(frontMatter +
-		"# Markdown to HTML with front matter parsed\n" +
-		title +
+	if doc, err := app.Convert("", []byte(frontMatter+
+		"# Markdown to HTML with front matter parsed\n"+
+		title+
 		codeFence)); err != nil {
-		panic("mdYAMLToHTML()")
+		panic("mdYAMLTest()")
 		quit(err, 1)
 	} else {
-		fmt.Println(string(b))
-		fmt.Printf("Front matter as YAML: %v\n", app.metaData)
+		fmt.Println(string(doc.HTML))
+		fmt.Printf("Front matter as YAML: %v\n", doc.Meta)
+	}
+}
+
+// mdOtherFrontMatterTest() shows that TOML and JSON front matter
+// end up in Document.Meta looking just like YAML does.
+func mdOtherFrontMatterTest() {
+	var app = NewApp()
+	for _, front := range []string{tomlFrontMatter, jsonFrontMatter} {
+		if doc, err := app.Convert("", []byte(front+
+			"# Markdown to HTML with TOML or JSON front matter parsed\n"+
+			title)); err != nil {
+			quit(err, 1)
+		} else {
+			fmt.Println(string(doc.HTML))
+			fmt.Printf("Front matter: %v\n", doc.Meta)
+		}
+	}
+}
+
+// BlogPage is the front matter expected in the blog section
+type BlogPage struct {
+	Title   string `meta:",required"`
+	Month   string
+	Summary string
+	Tags    []string
+	Theme   string
+	Draft   bool
+}
+
+// mdSchemaTest() checks front matter against a registered struct.
+// The first document is fine. The second has a misspelled key,
+// a string where a list belongs, and is missing its title.
+func mdSchemaTest() {
+	var app = NewApp()
+	if err := app.registerPageType("blog", BlogPage{}); err != nil {
+		quit(err, 1)
+	}
+	if doc, err := app.Convert("blog/good.md", []byte(frontMatter+title)); err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("Front matter as a BlogPage: %+v\n", doc.Page)
+	}
+	const typos = `---
+Titel: goldmark-meta
+Month: January
+Tags: markdown
+---
+`
+	if doc, err := app.Convert("blog/typos.md", []byte(typos+title)); err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Println("Problems in front matter:")
+		for _, warning := range doc.Warnings {
+			fmt.Printf("  %v\n", warning)
+		}
+	}
+}
+
+// mdConcurrentTest() converts documents in several goroutines at
+// once with a single App. Each gets its own front matter back.
+func mdConcurrentTest() {
+	var app = NewApp()
+	var wg sync.WaitGroup
+	results := make([]string, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			source := fmt.Sprintf("---\nTitle: Document %d\n---\n# Heading %d\n## Section\n", i, i)
+			doc, err := app.Convert("", []byte(source))
+			if err != nil {
+				results[i] = err.Error()
+				return
+			}
+			results[i] = fmt.Sprintf("%v: %v", doc.Meta["Title"], doc.Headings)
+		}(i)
+	}
+	wg.Wait()
+	for _, result := range results {
+		fmt.Println(result)
+	}
+}
+
+// projectConfig is a project config file that turns
+// on the typographer and changes the highlight style.
+const projectConfig = `
+[markdown]
+typographer = true
+highlight-style = "monokai"
+`
+
+// mdOptionsTest() converts the same Markdown with the options
+// from projectConfig, then with a document's front matter
+// turning hard wraps on and highlighting off, and then with
+// CSS classes instead of colors. A code fence can number its
+// lines and highlight some of them with options after the
+// language, such as {linenos=true hl_lines=[2,4]}.
+func mdOptionsTest() {
+	var app = NewApp()
+	if err := app.configure(projectConfig); err != nil {
+		quit(err, 1)
+	}
+	const markdown = "\"Smart quotes\" -- and\nhard wraps...\n" + codeFence
+	const hardWraps = `---
+markdown:
+  hard-wraps: true
+  highlight-style: ""
+---
+`
+	const classes = `---
+markdown:
+  highlight-classes: true
+---
+` + "```go {linenos=true hl_lines=[2]}\nfunc main() {\n\tfmt.Println(\"hi\")\n}\n```\n"
+	for _, source := range []string{markdown, hardWraps + markdown, classes} {
+		doc, err := app.Convert("", []byte(source))
+		if err != nil {
+			quit(err, 1)
+		}
+		fmt.Println(string(doc.HTML))
+	}
+}
+
+// templateTutorial is a page about templates, so its code
+// examples are full of actions that mustn't be executed.
+// Its list of tags is made by a template, and is only a
+// Markdown list if the template runs first. So is the
+// heading's id made from its text.
+const templateTutorial = `---
+Title: Go templates
+Name: Gopher
+Tags:
+    - templates
+    - tutorial
+---
+# {{ .Title }}
+
+Hello, {{ .Name }}. Show a field with ` + "`{{ .Name }}`" + `, like this:
+
+` + "```go\nt := template.Must(template.New(\"hi\").Parse(\"Hi {{ .Name }}\"))\n```" + `
+
+{{ range .Tags }}- {{ . }}
+{{ end }}`
+
+// mdTemplateOrderTest() renders templateTutorial with
+// templates executed after the Markdown, then before it.
+func mdTemplateOrderTest() {
+	for _, config := range []string{"", "[templates]\norder = \"template-first\"\n"} {
+		var app = NewApp()
+		if err := app.configure(config); err != nil {
+			quit(err, 1)
+		}
+		doc, err := app.Render("", []byte(templateTutorial))
+		if err != nil {
+			quit(err, 1)
+		}
+		fmt.Printf("Executing templates %s:\n%s\n", app.order, doc.HTML)
 	}
 }
 
 func mdYAMLTemplateTest() {
 	var app = NewApp()
 	var err error
-	var b []byte
-	if b, err = app.mdYAMLToHTML([]byte(frontMatter +
-		"# Markdown to HTML with front matter parsed and executed in template\n" +
-		title +
+	var doc *Document
+	if doc, err = app.Convert("", []byte(frontMatter+
+		"# Markdown to HTML with front matter parsed and executed in template\n"+
+		title+
 		codeFence)); err != nil {
 		panic("mdYAMLTemplateTest()")
 	}
 	var t string
-	t = app.doTemplate("METABUZZ", string(b))
+	t = app.doTemplate("METABUZZ", string(doc.HTML), doc.Meta)
 	fmt.Println(t)
 }
 
 func mdYAMLTemplateFuncTest() {
 	var app = NewApp()
+	// Execute the templates before converting the Markdown, so
+	// the headings, and the table of contents made from them,
+	// have {{ .Title }} filled in.
+	app.order = templateFirst
 	var err error
-	var b []byte
-	if b, err = app.mdYAMLToHTML([]byte(frontMatter +
-		"# Markdown to HTML with front matter parsed and executed in template, plus a custom template function\n" +
-		title +
-		ftimeExample +
+	var doc *Document
+	if doc, err = app.Render("", []byte(frontMatter+
+		"# Markdown to HTML with front matter parsed and executed in template, plus a custom template function\n"+
+		title+
+		ftimeExample+
+		tocExample+
 		codeFence)); err != nil {
 		panic("mdYAMLTemplateFuncTest()")
 	}
-	var t string
-	if t, err = app.doTemplateFuncs("METABUZZ", string(b)); err != nil {
+	// The table of contents goes before the document, not in its
+	// Markdown, where it would end up inside a paragraph, which
+	// can't hold a list.
+	var nav string
+	if nav, err = app.doTemplateFuncs("METABUZZ", "<nav>\n{{ toc 1 3 }}</nav>\n", doc); err != nil {
 		panic("mdYAMLTemplateFuncTest()")
 	}
-	fmt.Println(t)
+	fmt.Println(nav + string(doc.HTML))
 }
 
-// mdYAMLtoHTML converts a Markdown document with optional
-// YAML front matter to HTML. YAML is written to app.metaData
-// Returns a byte slice containing the HTML source.
-// Pre: parser.NewContext() has already been called on app.parserCtx
-func (app *App) mdYAMLToHTML(source []byte) ([]byte, error) {
+// Document is the result of converting a single Markdown document.
+type Document struct {
+	// The converted Markdown
+	HTML []byte
+
+	// Front matter, whether it was YAML, TOML, or JSON.
+	// nil if there wasn't any.
+	Meta map[string]interface{}
+
+	// Front matter decoded into the struct registered for
+	// the document's section, if there is one.
+	Page interface{}
+
+	// Every heading in the document, in order
+	Headings []Heading
+
+	// The headings as nested lists of links, for a table of
+	// contents. Only headings from the front matter's toc-min
+	// to toc-max levels are included, or 2 to 3 by default.
+	TOC            string
+	tocMin, tocMax int
+
+	// Problems that didn't stop the document from being
+	// converted, such as front matter that doesn't match
+	// the schema for its section.
+	Warnings []error
+}
+
+// Convert converts a Markdown document with optional front
+// matter to HTML. The front matter can be any of these:
+//   - YAML between lines of ---
+//   - TOML between lines of +++
+//   - A JSON object whose opening { is the document's first line
+//
+// filename is where source came from. It's only used to find the
+// document's section, and the schema its front matter is checked
+// against, so it can be empty. Each call gets its own parser
+// context, so Convert can be called from many goroutines at once.
+func (app *App) Convert(filename string, source []byte) (*Document, error) {
+	return app.convert(filename, source, nil)
+}
+
+// convert is Convert. If p isn't nil, code and raw HTML in the
+// HTML it returns are replaced by p's placeholders.
+func (app *App) convert(filename string, source []byte, p *protector) (*Document, error) {
+	// goldmark-meta handles YAML. TOML and JSON are removed
+	// from the source before goldmark sees it.
+	front, body, err := splitFrontMatter(source)
+	if err != nil {
+		return nil, err
+	}
+	md := app.mdParser
+	ctx := parser.NewContext()
+	root := md.Parser().Parse(text.NewReader(body), parser.WithContext(ctx))
+	if front == nil {
+		// Obtain YAML front matter from document.
+		if front, err = meta.TryGet(ctx); err != nil {
+			return nil, err
+		}
+	}
+	front = normalizeMetaData(front)
+
+	doc := &Document{Meta: front, tocMin: defaultTOCMin, tocMax: defaultTOCMax}
+	options := app.options
+	var showTOC bool
+	for key, value := range front {
+		switch strings.ToLower(key) {
+		case "markdown":
+			overrides, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("front matter %s should be a table of options, not %s", key, describeValue(value))
+			}
+			if options, err = options.with(overrides); err != nil {
+				return nil, fmt.Errorf("front matter %s: %w", key, err)
+			}
+		case "toc":
+			var ok bool
+			if showTOC, ok = value.(bool); !ok {
+				return nil, fmt.Errorf("front matter %s should be true or false, not %s", key, describeValue(value))
+			}
+		case "toc-min":
+			doc.tocMin, err = tocLevel(key, value)
+		case "toc-max":
+			doc.tocMax, err = tocLevel(key, value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if showTOC {
+		// The table of contents links to every heading.
+		options.AutoHeadingIDs = true
+	}
+	// YAML front matter isn't known until the document has been
+	// parsed, so if it changes the options, parse it again.
+	if options != app.options {
+		md = app.converter(options)
+		root = md.Parser().Parse(text.NewReader(body), parser.WithContext(parser.NewContext()))
+	}
+	doc.Headings = documentHeadings(root, body)
+	if p != nil {
+		if err := p.protectNodes(md, root, body); err != nil {
+			return nil, err
+		}
+	}
 	var buf bytes.Buffer
-	// Convert Markdown source to HTML and deposit in buf.Bytes().
-	if err := app.mdParser.Convert(source, &buf, parser.WithContext(app.mdParserCtx)); err != nil {
-		return []byte{}, err
+	if err := md.Renderer().Render(&buf, body, root); err != nil {
+		return nil, err
 	}
-	// Obtain YAML front matter from document.
-	app.metaData = meta.Get(app.mdParserCtx)
-	return buf.Bytes(), nil
+	doc.TOC = tocHTML(doc.Headings, doc.tocMin, doc.tocMax)
+	doc.HTML = buf.Bytes()
+	if showTOC {
+		doc.HTML = append([]byte(doc.TOC), doc.HTML...)
+	}
+
+	if schema, ok := app.schemas[sectionOf(filename)]; ok {
+		var page reflect.Value
+		if schema.pageType != nil {
+			page = reflect.New(schema.pageType)
+			doc.Page = page.Interface()
+		}
+		for _, e := range schema.check(filename, source, doc.Meta, page) {
+			doc.Warnings = append(doc.Warnings, e)
+		}
+	}
+	return doc, nil
 }
 
-// mdYAMLtoHTMLStr converts a Markdown document with optional YAML front matter to HTML. YAML is written to app.metaData
-// Returns a string containing the HTML source.
-// Pre: parser.NewContext() has already been called on app.parserCtx
-func (app *App) mdYAMLToHTMLStr(source []byte) (string, error) {
-	var buf bytes.Buffer
-	// Convert Markdown source to HTML and deposit in buf.Bytes().
-	if err := app.mdParser.Convert(source, &buf, parser.WithContext(app.mdParserCtx)); err != nil {
-		return "", err
+// TEMPLATE ORDER
+// Render converts a document and executes the Go templates in it.
+// Which comes first is up to the App's templateOrder:
+//
+//   - markdown-first executes templates in the HTML goldmark
+//     produces, so they can't change the Markdown.
+//   - template-first executes them in the Markdown, so they can
+//     produce Markdown, but their output is then converted.
+//
+// Either way, code fences, indented code, code spans and raw HTML
+// blocks are left alone, so a tutorial on templates can show
+// {{ .Title }} in its examples. That's done by swapping each of
+// them for a placeholder while the templates run.
+
+// templateOrder says whether Render executes
+// templates before or after converting Markdown.
+type templateOrder int
+
+const (
+	markdownFirst templateOrder = iota
+	templateFirst
+)
+
+func (o templateOrder) String() string {
+	if o == templateFirst {
+		return "template-first"
+	}
+	return "markdown-first"
+}
+
+// parseTemplateOrder returns the order named s.
+func parseTemplateOrder(s string) (templateOrder, error) {
+	for _, o := range []templateOrder{markdownFirst, templateFirst} {
+		if s == o.String() {
+			return o, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown template order %q. Use markdown-first or template-first", s)
+}
+
+// Render is like Convert, but also executes the Go templates in
+// the document, with functions from addTemplateFunctions and the
+// data described at doTemplateFuncs, in the App's order.
+func (app *App) Render(filename string, source []byte) (*Document, error) {
+	if app.order == templateFirst {
+		return app.renderTemplateFirst(filename, source)
+	}
+	p := newProtector(source)
+	doc, err := app.convert(filename, source, p)
+	if err != nil {
+		return nil, err
+	}
+	HTML, err := app.doTemplateFuncs(filename, string(doc.HTML), doc)
+	if err != nil {
+		return nil, err
+	}
+	doc.HTML = []byte(p.restore(HTML))
+	return doc, nil
+}
+
+// renderTemplateFirst executes the templates in the Markdown of
+// source, then converts the result. The templates see the front
+// matter and headings of the document as it was before they ran.
+func (app *App) renderTemplateFirst(filename string, source []byte) (*Document, error) {
+	before, err := app.Convert(filename, source)
+	if err != nil {
+		return nil, err
+	}
+	// Front matter isn't part of the template.
+	_, body, err := splitFrontMatter(source)
+	if err != nil {
+		return nil, err
+	}
+	body = body[yamlFrontMatterLen(body):]
+	header := source[:len(source)-len(body)]
+
+	p := newProtector(source)
+	root := app.mdParser.Parser().Parse(text.NewReader(body), parser.WithContext(parser.NewContext()))
+	markdown, err := app.doTemplateFuncs(filename, p.protectSource(root, body), before)
+	if err != nil {
+		return nil, err
+	}
+	return app.Convert(filename, append(append([]byte{}, header...), p.restore(markdown)...))
+}
+
+// yamlFrontMatterLen returns the length of the YAML front
+// matter at the start of source, or 0 if there isn't any.
+func yamlFrontMatterLen(source []byte) int {
+	line, rest := nextLine(source)
+	if !fenceLine(line, "---") {
+		return 0
+	}
+	for len(rest) > 0 {
+		if line, rest = nextLine(rest); fenceLine(line, "---") {
+			return len(source) - len(rest)
+		}
 	}
-	// Obtain YAML front matter from document.
-	app.metaData = meta.Get(app.mdParserCtx)
-	return string(buf.Bytes()), nil
+	return 0
+}
+
+// protector swaps the parts of a document that templates mustn't
+// touch for placeholders, and back again once they've run.
+type protector struct {
+	// Placeholders are this, the number of what
+	// they replace in saved, then a NUL.
+	prefix string
+	saved  []string
+}
+
+// newProtector returns a protector for the document source,
+// with placeholders that can't be confused with anything in it.
+func newProtector(source []byte) *protector {
+	prefix := "\x00protected"
+	for bytes.Contains(source, []byte(prefix)) {
+		prefix += "\x00"
+	}
+	return &protector{prefix: prefix}
+}
+
+// placeholder saves s and returns the placeholder for it.
+func (p *protector) placeholder(s string) string {
+	p.saved = append(p.saved, s)
+	return fmt.Sprintf("%s%d\x00", p.prefix, len(p.saved)-1)
+}
+
+// restore returns s with each placeholder replaced
+// by what it stood for.
+func (p *protector) restore(s string) string {
+	re := regexp.MustCompile(regexp.QuoteMeta(p.prefix) + "([0-9]+)\x00")
+	return re.ReplaceAllStringFunc(s, func(m string) string {
+		var i int
+		fmt.Sscan(re.FindStringSubmatch(m)[1], &i)
+		return p.saved[i]
+	})
+}
+
+// protected returns where the code and raw HTML in n are in
+// source, whose parsed form it is, or false if n isn't code.
+func protected(n ast.Node) (start, stop int, ok bool) {
+	switch n := n.(type) {
+	case *ast.FencedCodeBlock, *ast.CodeBlock, *ast.HTMLBlock:
+		lines := n.Lines()
+		if lines.Len() == 0 {
+			return 0, 0, false
+		}
+		start, stop = lines.At(0).Start, lines.At(lines.Len()-1).Stop
+		if html, ok := n.(*ast.HTMLBlock); ok && html.HasClosure() {
+			stop = html.ClosureLine.Stop
+		}
+		return start, stop, true
+	case *ast.CodeSpan:
+		start = -1
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			if t, ok := c.(*ast.Text); ok {
+				if start < 0 {
+					start = t.Segment.Start
+				}
+				stop = t.Segment.Stop
+			}
+		}
+		return start, stop, start >= 0
+	}
+	return 0, 0, false
+}
+
+// protectedNodes returns the code and raw HTML in root.
+func protectedNodes(root ast.Node) (nodes []ast.Node) {
+	ast.Walk(root, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		if _, _, ok := protected(n); ok {
+			nodes = append(nodes, n)
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return nodes
+}
+
+// protectSource returns source, whose parsed form is root,
+// with its code and raw HTML replaced by placeholders.
+func (p *protector) protectSource(root ast.Node, source []byte) string {
+	var b strings.Builder
+	last := 0
+	for _, n := range protectedNodes(root) {
+		start, stop, _ := protected(n)
+		b.Write(source[last:start])
+		b.WriteString(p.placeholder(string(source[start:stop])))
+		last = stop
+	}
+	b.Write(source[last:])
+	return b.String()
+}
+
+// protectNodes renders the code and raw HTML in root with md,
+// and replaces each of them with a node that renders as a
+// placeholder for that HTML.
+func (p *protector) protectNodes(md goldmark.Markdown, root ast.Node, source []byte) error {
+	for _, n := range protectedNodes(root) {
+		var buf bytes.Buffer
+		if err := md.Renderer().Render(&buf, source, n); err != nil {
+			return err
+		}
+		placeholder := p.placeholder(buf.String())
+		var replacement ast.Node = &protectedInline{placeholder: placeholder}
+		if n.Type() == ast.TypeBlock {
+			replacement = &protectedBlock{placeholder: placeholder}
+		}
+		n.Parent().ReplaceChild(n.Parent(), n, replacement)
+	}
+	return nil
+}
+
+// kindProtected is the kind of node that stands in for
+// code while templates are executed.
+var kindProtected = ast.NewNodeKind("Protected")
+
+// protectedBlock stands in for a code block or raw HTML block.
+type protectedBlock struct {
+	ast.BaseBlock
+	placeholder string
+}
+
+func (n *protectedBlock) Kind() ast.NodeKind { return kindProtected }
+
+func (n *protectedBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Placeholder": n.placeholder}, nil)
+}
+
+// protectedInline stands in for a code span.
+type protectedInline struct {
+	ast.BaseInline
+	placeholder string
+}
+
+func (n *protectedInline) Kind() ast.NodeKind { return kindProtected }
+
+func (n *protectedInline) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Placeholder": n.placeholder}, nil)
+}
+
+// protectedRenderer renders protected nodes as their placeholders.
+type protectedRenderer struct{}
+
+func (r protectedRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindProtected, func(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			switch n := n.(type) {
+			case *protectedBlock:
+				w.WriteString(n.placeholder)
+			case *protectedInline:
+				w.WriteString(n.placeholder)
+			}
+		}
+		return ast.WalkSkipChildren, nil
+	})
+}
+
+// funcs returns the template functions that depend on the
+// document. {{ toc }} is the table of contents, and
+// {{ toc 1 4 }} is one with headings from <h1> to <h4>.
+func (doc *Document) funcs() template.FuncMap {
+	return template.FuncMap{
+		"toc": func(levels ...int) (string, error) {
+			switch len(levels) {
+			case 0:
+				return doc.TOC, nil
+			case 2:
+				return tocHTML(doc.Headings, levels[0], levels[1]), nil
+			}
+			return "", fmt.Errorf("toc takes a minimum and maximum level, or nothing, not %v", levels)
+		},
+	}
+}
+
+// tocLevel returns value, the front matter key, as a heading level.
+func tocLevel(key string, value interface{}) (int, error) {
+	if level, ok := value.(int); ok && level >= 1 && level <= 6 {
+		return level, nil
+	}
+	return 0, fmt.Errorf("front matter %s should be a heading level from 1 to 6, not %s", key, describeValue(value))
+}
+
+// splitFrontMatter looks for TOML or JSON front matter at the start
+// of source. If it finds some it returns the decoded front matter
+// and the Markdown that follows it. Otherwise it returns nil and
+// source unchanged, leaving YAML front matter to goldmark-meta.
+func splitFrontMatter(source []byte) (map[string]interface{}, []byte, error) {
+	front := map[string]interface{}{}
+	firstLine, rest := nextLine(source)
+	switch {
+	case fenceLine(firstLine, "+++"):
+		// TOML runs until the next line of +++
+		for body := rest; len(body) > 0; {
+			var line []byte
+			end := len(source) - len(body)
+			if line, body = nextLine(body); fenceLine(line, "+++") {
+				if _, err := toml.Decode(string(source[len(source)-len(rest):end]), &front); err != nil {
+					return nil, nil, fmt.Errorf("TOML front matter: %w", err)
+				}
+				return front, body, nil
+			}
+		}
+		return nil, nil, fmt.Errorf("TOML front matter has no closing +++")
+	case fenceLine(firstLine, "{"):
+		// JSON is a single object, whose opening brace is
+		// on a line by itself, as in Hugo. That way a page
+		// starting with {{ }} isn't mistaken for JSON. The
+		// Markdown starts on the line after its closing brace.
+		dec := json.NewDecoder(bytes.NewReader(source))
+		dec.UseNumber()
+		if err := dec.Decode(&front); err != nil {
+			return nil, nil, fmt.Errorf("JSON front matter: %w", err)
+		}
+		_, body := nextLine(source[dec.InputOffset():])
+		return front, body, nil
+	}
+	return nil, source, nil
+}
+
+// nextLine returns the first line of b, without its newline,
+// and what follows it.
+func nextLine(b []byte) (line, rest []byte) {
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+// fenceLine returns true if line consists of fence and
+// nothing else but trailing whitespace.
+func fenceLine(line []byte, fence string) bool {
+	return strings.TrimRight(string(line), " \t\r") == fence
+}
+
+// normalizeMetaData gives front matter the same shape whether it
+// came from YAML, TOML, or JSON, so templates don't care which
+// one a page used. Nested maps become map[string]interface{},
+// lists become []interface{}, whole numbers become int, other
+// numbers float64, and dates become strings, which is how
+// goldmark-meta returns them from YAML.
+func normalizeMetaData(front map[string]interface{}) map[string]interface{} {
+	if front == nil {
+		return nil
+	}
+	return normalizeMetaValue(front).(map[string]interface{})
+}
+
+func normalizeMetaValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = normalizeMetaValue(item)
+		}
+		return m
+	case map[interface{}]interface{}:
+		// YAML allows keys that aren't strings
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalizeMetaValue(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = normalizeMetaValue(item)
+		}
+		return list
+	case []map[string]interface{}:
+		// TOML array of tables
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = normalizeMetaValue(item)
+		}
+		return list
+	case int64:
+		return int(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	case time.Time:
+		// TOML dates and times without an offset get a
+		// special location, which tells them apart.
+		switch v.Location().String() {
+		case "date-local":
+			return v.Format("2006-01-02")
+		case "time-local":
+			return v.Format("15:04:05.999999999")
+		case "datetime-local":
+			return v.Format("2006-01-02T15:04:05.999999999")
+		}
+		return v.Format(time.RFC3339Nano)
+	}
+	return value
+}
+
+// FRONT MATTER SCHEMAS
+// Front matter is a loose map, so a typo like Titel: or a
+// string where a list belongs only shows up when a template
+// misbehaves. Each content section can register a schema,
+// either a Go struct or a schema file, and front matter in
+// that section is checked against it.
+
+// frontMatterSchema lists the keys allowed in one section's
+// front matter.
+type frontMatterSchema struct {
+	// Keyed by lowercase name, because keys are case insensitive
+	fields map[string]schemaField
+	// The registered struct type, if there is one. Front matter
+	// is decoded into a new one of these for each document.
+	pageType reflect.Type
+}
+
+// schemaField describes a single front matter key.
+type schemaField struct {
+	// Name as it appears in the struct or schema file
+	name string
+	// One of string, int, float, bool, list, map, date, or any
+	kind     string
+	required bool
+	// Index of the struct field, if there is a struct
+	index int
+}
+
+// frontMatterError is a problem with a single front matter key.
+type frontMatterError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e frontMatterError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// frontMatterErrors is everything wrong with a document's front matter.
+type frontMatterErrors []frontMatterError
+
+func (e frontMatterErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// registerPageType uses the struct page, or a pointer to one, as
+// the schema for documents in section. Exported fields are the
+// allowed keys, matched without regard to case. A meta tag can
+// rename a field or mark it required:
+//
+//	Title string   `meta:",required"`
+//	Tags  []string `meta:"keywords"`
+//
+// Based on structInfo() in structinfo.go.
+func (app *App) registerPageType(section string, page interface{}) error {
+	t := reflect.TypeOf(page)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return fmt.Errorf("%v is not a struct", page)
+	}
+	schema := &frontMatterSchema{fields: make(map[string]schemaField), pageType: t}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		field := schemaField{name: f.Name, kind: kindOf(f.Type), index: i}
+		tag := strings.Split(f.Tag.Get("meta"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		if tag[0] != "" {
+			field.name = tag[0]
+		}
+		for _, option := range tag[1:] {
+			if option == "required" {
+				field.required = true
+			}
+		}
+		schema.fields[strings.ToLower(field.name)] = field
+	}
+	app.schemas[section] = schema
+	return nil
+}
+
+// registerSchemaFile reads the schema for documents in section from
+// a TOML file with a table for each allowed key, like this:
+//
+//	[Title]
+//	type = "string"
+//	required = true
+//
+//	[Tags]
+//	type = "list"
+//
+// type is one of string, int, float, bool, list, map, date, or any.
+func (app *App) registerSchemaFile(section string, filename string) error {
+	var fields map[string]struct {
+		Type     string
+		Required bool
+	}
+	if _, err := toml.DecodeFile(filename, &fields); err != nil {
+		return err
+	}
+	schema := &frontMatterSchema{fields: make(map[string]schemaField)}
+	for name, f := range fields {
+		switch f.Type {
+		case "":
+			f.Type = "any"
+		case "string", "int", "float", "bool", "list", "map", "date", "any":
+		default:
+			return fmt.Errorf("%s: %s has unknown type %s", filename, name, f.Type)
+		}
+		schema.fields[strings.ToLower(name)] = schemaField{name: name, kind: f.Type, required: f.Required}
+	}
+	app.schemas[section] = schema
+	return nil
+}
+
+// kindOf returns the schema type that matches Go type t.
+func kindOf(t reflect.Type) string {
+	if t == reflect.TypeOf(time.Time{}) {
+		return "date"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	case reflect.Map:
+		return "map"
+	}
+	return "any"
+}
+
+// sectionOf returns the content section filename belongs to,
+// which is its first directory. Files at the top level are
+// in section "".
+func sectionOf(filename string) string {
+	dir := filepath.ToSlash(filepath.Dir(filepath.Clean(filename)))
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return strings.Split(strings.TrimPrefix(dir, "/"), "/")[0]
+}
+
+// mdFileToHTML reads filename and converts it with Convert.
+func (app *App) mdFileToHTML(filename string) (*Document, error) {
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return app.Convert(filename, source)
+}
+
+// check compares front matter against the schema. filename and source
+// are only used to report where problems are. If page points to a
+// struct, each valid value is stored in its field.
+func (schema *frontMatterSchema) check(filename string, source []byte, front map[string]interface{}, page reflect.Value) (errs frontMatterErrors) {
+	lines := frontMatterLines(source)
+	seen := make(map[string]bool)
+	// Sort keys so the errors come out in a predictable order
+	keys := make([]string, 0, len(front))
+	for key := range front {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return lines[keys[i]] < lines[keys[j]] })
+	for _, key := range keys {
+		value := front[key]
+		line := lines[key]
+		field, ok := schema.fields[strings.ToLower(key)]
+		if !ok {
+			errs = append(errs, frontMatterError{filename, line, fmt.Sprintf("unknown key %s", key)})
+			continue
+		}
+		seen[strings.ToLower(key)] = true
+		if !matchesKind(value, field.kind) {
+			errs = append(errs, frontMatterError{filename, line,
+				fmt.Sprintf("%s should be %s, not %s", key, withArticle(field.kind), describeValue(value))})
+			continue
+		}
+		if page.IsValid() {
+			if err := setField(page.Elem().Field(field.index), value); err != nil {
+				errs = append(errs, frontMatterError{filename, line, fmt.Sprintf("%s: %v", key, err)})
+			}
+		}
+	}
+	// Sort these too. Missing keys are reported on the
+	// first line, since they aren't anywhere.
+	var missing []string
+	for lower, field := range schema.fields {
+		if field.required && !seen[lower] {
+			missing = append(missing, field.name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		errs = append(errs, frontMatterError{filename, 1, fmt.Sprintf("missing required key %s", name)})
+	}
+	return errs
+}
+
+// matchesKind returns true if a normalized front matter value
+// (see normalizeMetaValue) can be used as the schema type kind.
+func matchesKind(value interface{}, kind string) bool {
+	switch kind {
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "int":
+		_, ok := value.(int)
+		return ok
+	case "float":
+		switch value.(type) {
+		case int, float64:
+			return true
+		}
+		return false
+	case "bool":
+		_, ok := value.(bool)
+		return ok
+	case "list":
+		_, ok := value.([]interface{})
+		return ok
+	case "map":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "date":
+		s, ok := value.(string)
+		return ok && parseDate(s) != nil
+	}
+	return true
+}
+
+// describeValue names the type of a front matter value
+// the way a schema would.
+func describeValue(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "empty"
+	case string:
+		return "a string"
+	case int:
+		return "an int"
+	case float64:
+		return "a float"
+	case bool:
+		return "a bool"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a map"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func withArticle(kind string) string {
+	if kind == "int" || kind == "any" {
+		return "an " + kind
+	}
+	return "a " + kind
+}
+
+// parseDate accepts the date formats front matter normally uses.
+func parseDate(s string) *time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// setField stores a front matter value, already checked by
+// matchesKind, in a struct field.
+func setField(field reflect.Value, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	if field.Type() == reflect.TypeOf(time.Time{}) {
+		field.Set(reflect.ValueOf(*parseDate(value.(string))))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if i, ok := value.(int); ok {
+			value = float64(i)
+		}
+	case reflect.Slice:
+		list := value.([]interface{})
+		s := reflect.MakeSlice(field.Type(), len(list), len(list))
+		for i, item := range list {
+			if err := setField(s.Index(i), item); err != nil {
+				return fmt.Errorf("item %d: %w", i+1, err)
+			}
+		}
+		field.Set(s)
+		return nil
+	}
+	v := reflect.ValueOf(value)
+	if !v.Type().ConvertibleTo(field.Type()) {
+		return fmt.Errorf("can't store %s in %s", describeValue(value), field.Type())
+	}
+	// Convert() is happy to turn an int into a string, which isn't wanted.
+	if field.Kind() == reflect.String && v.Kind() != reflect.String {
+		return fmt.Errorf("can't store %s in %s", describeValue(value), field.Type())
+	}
+	field.Set(v.Convert(field.Type()))
+	return nil
+}
+
+// frontMatterLines returns the line in source where each top-level
+// front matter key appears, counting from 1, whether the front matter
+// is YAML, TOML, or JSON.
+func frontMatterLines(source []byte) map[string]int {
+	lines := make(map[string]int)
+	firstLine, rest := nextLine(source)
+	switch {
+	case fenceLine(firstLine, "---"):
+		// YAML. yaml.v3 keeps track of where everything is.
+		var block []byte
+		for body := rest; len(body) > 0; {
+			var line []byte
+			end := len(source) - len(body)
+			if line, body = nextLine(body); fenceLine(line, "---") {
+				block = source[len(source)-len(rest) : end]
+				break
+			}
+		}
+		var doc yaml.Node
+		if yaml.Unmarshal(block, &doc) != nil || len(doc.Content) == 0 {
+			return lines
+		}
+		m := doc.Content[0]
+		for i := 0; i+1 < len(m.Content); i += 2 {
+			// Line 1 is the opening ---
+			lines[m.Content[i].Value] = m.Content[i].Line + 1
+		}
+	case fenceLine(firstLine, "+++"):
+		// TOML. Top-level keys are the ones before the first
+		// [table], and look like key = value.
+		for n, body := 2, rest; len(body) > 0; n++ {
+			var line []byte
+			line, body = nextLine(body)
+			trimmed := strings.TrimSpace(string(line))
+			if fenceLine(line, "+++") || strings.HasPrefix(trimmed, "[") {
+				break
+			}
+			if i := strings.Index(trimmed, "="); i > 0 && !strings.HasPrefix(trimmed, "#") {
+				lines[strings.Trim(strings.TrimSpace(trimmed[:i]), `"'`)] = n
+			}
+		}
+	case fenceLine(firstLine, "{"):
+		// JSON. Read the outer object's keys one at a time,
+		// noting the offset of each.
+		dec := json.NewDecoder(bytes.NewReader(source))
+		if _, err := dec.Token(); err != nil {
+			return lines
+		}
+		for dec.More() {
+			offset := dec.InputOffset()
+			key, err := dec.Token()
+			if err != nil {
+				return lines
+			}
+			var skip json.RawMessage
+			if dec.Decode(&skip) != nil {
+				return lines
+			}
+			// The offset is just past the previous value,
+			// so skip the comma and whitespace before the key.
+			start := int(offset) + bytes.IndexByte(source[offset:], '"')
+			lines[fmt.Sprint(key)] = bytes.Count(source[:start], []byte("\n")) + 1
+		}
+	}
+	return lines
 }
 
 // mdtoHTML converts a Markdown document to HTML.
 // YAML front matter should not be present.
 // Returns a byte slice containing the HTML source.
-// Pre: parser.NewContext() has already been called on app.parserCtx
 func (app *App) mdToHTML(source []byte) ([]byte, error) {
 	var buf bytes.Buffer
 	// Convert Markdown source to HTML and deposit in buf.Bytes().
-	if err := app.mdParser.Convert(source, &buf, parser.WithContext(app.mdParserCtx)); err != nil {
+	if err := app.mdParser.Convert(source, &buf, parser.WithContext(parser.NewContext())); err != nil {
 		return []byte{}, err
 	}
 	return buf.Bytes(), nil
 }
 
-// doTemplate takes HTML in source, expects parsed front
-// matter in app.metaData, and executes Go templates
-// against the source.
+// doTemplate takes HTML in source and executes Go templates
+// in it against data, usually a Document's Meta.
 // Returns a string containing the HTML with the
 // template values embedded.
-func (app *App) doTemplate(templateName string, source string) string {
+func (app *App) doTemplate(templateName string, source string, data interface{}) string {
 	if templateName == "" {
 		templateName = "Metabuzz"
 	}
@@ -249,7 +1411,7 @@ func (app *App) doTemplate(templateName string, source string) string {
 		quit(err, 1)
 	}
 	buf := new(bytes.Buffer)
-	err = tmpl.Execute(buf, app.metaData)
+	err = tmpl.Execute(buf, data)
 
 	if err != nil {
 		quit(err, 1)
@@ -258,24 +1420,29 @@ func (app *App) doTemplate(templateName string, source string) string {
 
 }
 
-// doTemplateFuncs takes HTML in source, expects parsed front
-// matter in app.metaData, and executes Go templates
-// against the source. It also handles user-defined
-// functions, expected in funcMap
+// doTemplateFuncs takes HTML in source and executes Go
+// templates in it against doc's front matter, with doc
+// itself as .Page, so {{ .Title }} and {{ .Page.Headings }}
+// both work. It also handles user-defined
+// functions, expected in funcMap, and the document's toc.
 // Returns a string containing the HTML with the
 // template values embedded.
-func (app *App) doTemplateFuncs(templateName string, source string) (string, error) {
+func (app *App) doTemplateFuncs(templateName string, source string, doc *Document) (string, error) {
 	if templateName == "" {
 		templateName = "Metabuzz"
 	}
+	data := make(map[string]interface{}, len(doc.Meta)+1)
+	for key, value := range doc.Meta {
+		data[key] = value
+	}
+	data["Page"] = doc
 	var tmpl *template.Template
 	var err error
-	if tmpl, err = template.New(templateName).Funcs(app.funcs).Parse(source); err != nil {
-		// TODO: Function should return error
+	if tmpl, err = template.New(templateName).Funcs(app.funcs).Funcs(doc.funcs()).Parse(source); err != nil {
 		return "", err
 	}
 	buf := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(buf, templateName, app.metaData)
+	err = tmpl.ExecuteTemplate(buf, templateName, data)
 
 	if err != nil {
 		return "", err
@@ -291,12 +1458,27 @@ func main() {
 	// Markdown to HTML with YAML front matter parsed
 	mdYAMLTest()
 
+	// Markdown to HTML with TOML and JSON front matter parsed
+	mdOtherFrontMatterTest()
+
+	// Front matter checked against a schema
+	mdSchemaTest()
+
+	// One App converting documents in several goroutines
+	mdConcurrentTest()
+
+	// Markdown options from a project config and front matter
+	mdOptionsTest()
+
 	// Markdown to HTML with YAML front matter parsed and executed in template
 	mdYAMLTemplateTest()
 
-  // Markdown to HTML with front matter parsed and executed in template, plus a custom template function
+	// Markdown to HTML with front matter parsed and executed in template, plus a custom template function
 	mdYAMLTemplateFuncTest()
 
+	// Templates executed before and after Markdown, leaving code alone
+	mdTemplateOrderTest()
+
 }
 
 // ftime() returns the current, local, formatted time.
@@ -1,31 +1,132 @@
-package main // MicroCMS: One-file Markdown file to HTML CMS
+package main // MicroCMS: Markdown file to HTML CMS
+// Converts a tree of Markdown files into a site in WWW. YAML front
+// matter can set each page's title, language, stylesheets, layout,
+// output path, or mark it as a draft. Builds are incremental: pages
+// that haven't changed since the last build are skipped, and changing
+// a layout or the Markdown options converts the pages they affect.
+
 // git clone https://github.com/tomcam/microcms
 // cd microcms
 // go mod init github.com/tomcam/microcms
 // go mod tidy
+// It also needs configcodec.go, markdownpipeline.go, subcommands.go
+// and the starters directory from the directory this file is in.
+// Copy them in too, then either build microcms with go build, or add
+// configcodec.go markdownpipeline.go subcommands.go after main.go to
+// each go run example below.
 
 // Example invocations
+// List the commands, or describe one of them
+// go run main.go help
+// go run main.go help build
+
+// Build the whole site in the current directory into WWW
+// go run main.go build
+// go run main.go
+// Build the site in another directory
+// go run main.go -dir ~/raj/blog build
+
 // Include the 2 css files shown
-// go run main.go -styles "theme.css light-mode.css" foo.md
+// go run main.go build -styles "theme.css light-mode.css"
 
+// Convert only the files named, writing them to stdout
 // Get CSS file from CDN
-// go run main.go -styles "https://unpkg.com/spectre.css/dist/spectre.min.css" foo.md > foo.html
-// go run main.go -styles "//writ.cmcenroe.me/1.0.4/writ.min.css" foo.md > foo.html
+// go run main.go build -styles "https://unpkg.com/spectre.css/dist/spectre.min.css" foo.md > foo.html
+// go run main.go build foo.md -styles "//writ.cmcenroe.me/1.0.4/writ.min.css" > foo.html
+// A file whose name starts with a dash
+// go run main.go build -- -foo.md > foo.html
+
+// Wrap each page in your own html/template layout instead of the
+// built-in one. Any other files listed can define templates it uses.
+// go run main.go build -templates "layout.html partials.html"
+// A layout can list the page's headings with {{ toc }}, and
+// a page with toc: true in its front matter starts with them.
+
+// Publish the site at https://example.com/docs/ instead of at the
+// root of a domain. Links like /about.html become /docs/about.html.
+// go run main.go build -base-url https://example.com/docs/
+
+// Build the site, serve it at http://localhost:8080, and rebuild
+// and reload the browser whenever a file changes
+// go run main.go serve
+// go run main.go serve -addr localhost:3000
+// Wait for a full second without changes before rebuilding
+// go run main.go serve -quiet 1s
+
+// Start a new site, add a page to it, and remove what build generated
+// go run main.go init -sitename "My site" mysite
+// Start one from the blog starter kit in the starters directory
+// go run main.go init -theme blog -sitename "My blog" myblog
+// go run main.go -dir mysite new blog/first-post.md
+// go run main.go -dir mysite clean
+
+// Settings can also go in microcms.toml (or .yaml or .json) in the
+// project directory, or in environment variables, so MICROCMS_JOBS=2
+// is like -jobs 2. Flags win over environment variables, which win
+// over the config file, where a table such as [darwin] wins over the
+// rest of the file on that OS.
+// Convert Markdown with GitHub tables and highlighted code
+// go run main.go build -markdown.table -markdown.highlight-style monokai
+// Use CSS classes for highlighting, with a stylesheet that
+// switches to a dark style in dark mode
+// go run main.go build -markdown.highlight-style github -markdown.highlight-classes
+// go run main.go highlight-css -markdown.highlight-dark-style monokai assets/highlight.css
+// List every setting and where its value came from
+// go run main.go config show
+// Switch the config file from TOML to YAML. It refuses if anything,
+// like a date going to JSON, wouldn't survive the trip, unless -lossy.
+// go run main.go convert microcms.toml microcms.yaml
+// go run main.go convert -to json microcms.toml
+
+// Files to leave out of the site, and not to watch, are listed
+// in .microcmsignore in the project directory using the same
+// patterns as .gitignore. For example:
+//   drafts/
+//   *.bak
+//   !keep.bak
 
 // Notes:
 // - www is a subdir of project
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/BurntSushi/toml"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/radovskyb/watcher"
 	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/text"
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+	"html"
+	"html/template"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	texttemplate "text/template"
+	"time"
 )
 
 var defaultExample = `
@@ -37,245 +138,3179 @@ var docType = `
 <!DOCTYPE html>
 <html lang=`
 
+// Title used when neither the command line nor the
+// page itself supplies one.
+const defaultTitle = "powered by microCMS"
+
+// Patterns in this file in the project directory name
+// files that aren't part of the site. See ignoreRules.
+const ignoreFilename = ".microcmsignore"
+
+// Never part of the site unless the ignore file says otherwise
+var defaultIgnore = []string{"node_modules", "main.bak", ".git", "pub", ".DS_Store", ".gitignore", ignoreFilename,
+	"/microcms.toml", "/microcms.yaml", "/microcms.yml", "/microcms.json"}
+
+// assemble wraps the HTML fragment in article in a complete
+// HTML document with the given title, language, and stylesheets.
 func assemble(article string, title string, language string, styles []string) string {
 	var htmlFile string
 	var stylesheets string
 	for _, sheet := range styles {
-		s := fmt.Sprintf("\t<link rel=\"stylesheet\" href=\"%s\"/>\n", sheet)
+		if sheet == "" {
+			continue
+		}
+		s := fmt.Sprintf("\t<link rel=\"stylesheet\" href=\"%s\"/>\n", html.EscapeString(sheet))
 		stylesheets += s
 	}
-	htmlFile = docType + "\"" + language + "\">" + "\n" +
+	htmlFile = docType + "\"" + html.EscapeString(language) + "\">" + "\n" +
 		"<head>\n" +
 		"\t<meta charset=\"utf-8\">\n" +
 		"\t<meta name=\"viewport\" content=\"width=device-width, initial-scale=1.0\">\n" +
-		"\t<title>" + title + "</title>\n" +
+		"\t<title>" + html.EscapeString(title) + "</title>\n" +
 		stylesheets +
 		"</head>\n<body>" +
 		article +
 		"</body>\n</html>"
-	fmt.Println(htmlFile)
 	return htmlFile
 }
 
+func main() {
+	if err := runCommandLine(os.Args[1:]); err != nil {
+		// -h and help have already been shown.
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		quit("Error", err, 1)
+	}
+}
+
+// COMMAND LINE
+// The command line is made up of global flags, then a command
+// such as build, then that command's flags and arguments:
+//
+//   microcms [global flags] command [flags] [arguments]
+//
+// Global flags are also allowed after the command. A command's
+// flags and its arguments can be mixed in any order, and -- ends
+// the flags. With no command at all, microcms builds the site.
+
+// Publish directory, relative to the project directory
+const publishDir = "WWW"
+
+// Pages in this directory of the project are published at the
+// top of the site, so content/about.md becomes WWW/about.html.
+const contentDir = "content"
+
+// If the -templates flag isn't given and this file exists,
+// it's the layout for every page. Sites created by init use it.
+const defaultLayoutFile = "layouts/default.html"
+
+var (
+	// Global flags, allowed anywhere on the command line.
+	globalFlags = flag.NewFlagSet("microcms", flag.ContinueOnError)
+	projectDir  = globalFlags.String("dir", ".", "Project directory")
+
+	// Flags for settings in the site configuration. See Site.
+	buildCmd = siteFlags("build", "title", "language", "styles", "templates", "jobs", "keep-going", "base-url", "markdown")
+	// serve builds the site too, so it takes the same flags,
+	// except that it always serves the site at the root.
+	serveCmd = siteFlags("serve", "title", "language", "styles", "templates", "jobs", "keep-going", "addr", "quiet", "markdown")
+
+	// config show takes every setting's flag, to
+	// show what difference a flag would make.
+	configCmd = siteFlags("config")
+
+	// The highlight styles default to the site's, so with no
+	// flags highlight-css writes the stylesheet the site needs.
+	highlightCSSCmd = siteFlags("highlight-css", "markdown.highlight-style", "markdown.highlight-dark-style")
+
+	initCmd      = flag.NewFlagSet("init", flag.ContinueOnError)
+	initSiteName = initCmd.String("sitename", "", "Your site name (default: the directory's name)")
+	initTheme    = initCmd.String("theme", "plain", "Starter kit to create the site from: "+strings.Join(starterThemes(), ", "))
+	initForce    = initCmd.Bool("force", false, "Create the site even if the directory isn't empty, replacing any files in the way")
+
+	convertCmd   = flag.NewFlagSet("convert", flag.ContinueOnError)
+	convertTo    = convertCmd.String("to", "", "Format to convert to: toml, yaml or json (default: the output file's extension)")
+	convertLossy = convertCmd.Bool("lossy", false, "Convert even if the new format can't hold everything in the old one, like dates in JSON")
+
+	newCmd   = flag.NewFlagSet("new", flag.ContinueOnError)
+	newDraft = newCmd.Bool("draft", true, "Mark the new page as a draft")
+
+	cleanCmd = flag.NewFlagSet("clean", flag.ContinueOnError)
+)
+
+// commands lists every command by name.
+// subcommands.go adds help.
+var commands = map[string]*command{
+	"build": {
+		args:    "[flags] [filename...]",
+		summary: "Convert the site to HTML in " + publishDir + ", or convert the named files to stdout",
+		flags:   buildCmd,
+		run:     inProject(runBuild),
+	},
+	"serve": {
+		args:    "[flags]",
+		summary: "Build the site and serve it, rebuilding and reloading the browser as it changes",
+		flags:   serveCmd,
+		run:     inProject(runServe),
+	},
+	"init": {
+		args:    "[flags] [directory]",
+		summary: "Create a new site in directory, or the project directory",
+		flags:   initCmd,
+		run:     runInit,
+	},
+	"new": {
+		args:    "[flags] filename...",
+		summary: "Create new Markdown pages",
+		flags:   newCmd,
+		run:     inProject(runNew),
+	},
+	"config": {
+		args:    "show [flags]",
+		summary: "List the site's settings and where each came from",
+		flags:   configCmd,
+		run:     inProject(runConfig),
+	},
+	"highlight-css": {
+		args:    "[flags] [output]",
+		summary: "Write the stylesheet for code highlighted with highlight-classes to output or stdout",
+		flags:   highlightCSSCmd,
+		run:     inProject(runHighlightCSS),
+	},
+	"convert": {
+		args:    "[flags] input [output]",
+		summary: "Convert a config file between TOML, YAML and JSON, writing to output or stdout",
+		flags:   convertCmd,
+		run:     runConvert,
+	},
+	"clean": {
+		args:    "",
+		summary: "Remove " + publishDir + " and everything built into it",
+		flags:   cleanCmd,
+		run:     inProject(runClean),
+	},
+}
+
+// runCommandLine runs the command named on the command
+// line args, not including the program name.
+func runCommandLine(args []string) error {
+	// Global flags before the command. Parse stops at
+	// the command name, since it isn't a flag.
+	if err := globalFlags.Parse(args); err != nil {
+		return err
+	}
+	args = globalFlags.Args()
+	name := "build"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q. Run \"%s help\" for a list", name, globalFlags.Name())
+	}
+	positional, err := parseArgs(cmd.flags, args)
+	if err != nil {
+		return err
+	}
+	return cmd.run(positional)
+}
+
+// inProject returns run, changed to run in the project directory.
+func inProject(run func(args []string) error) func(args []string) error {
+	return func(args []string) error {
+		if err := os.Chdir(*projectDir); err != nil {
+			return fmt.Errorf("unable to change to project directory: %w", err)
+		}
+		return run(args)
+	}
+}
+
+// layout reads the site's templates. Every page in
+// the tree gets wrapped in the same layout.
+func (site *Site) layout() (*pageLayout, error) {
+	if err := site.Markdown.check(); err != nil {
+		return nil, err
+	}
+	layout, err := newLayout(site.templateFiles(), site.Name, site.Title, site.Language, site.Styles, site.BaseURL, site.Markdown)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read templates: %w", err)
+	}
+	return layout, nil
+}
+
+// templateFiles returns the site's template files,
+// or the project's default layout if there is one.
+func (site *Site) templateFiles() []string {
+	templates := site.Templates
+	if len(templates) == 0 && fileExists(defaultLayoutFile) {
+		templates = []string{defaultLayoutFile}
+	}
+	return templates
+}
+
+// buildTree builds every file in the current directory
+// that ignore doesn't match into publishDir. If changes isn't
+// nil only the files in it are looked at, unless they
+// affect every page. See mdDirectoryTreeToHTML.
+func (site *Site) buildTree(ignore *ignoreRules, changes changeSet) (*buildReport, error) {
+	// Template files may be edited while the server
+	// runs, so each build reads them again.
+	layout, err := site.layout()
+	if err != nil {
+		return nil, err
+	}
+	var markdownExtensions searchInfo
+	markdownExtensions.list = []string{".md", ".mkd", ".mdwn", ".mdown", ".mdtxt", ".mdtext", ".markdown"}
+	return mdDirectoryTreeToHTML(".", publishDir, ignore, markdownExtensions, site.Jobs, site.KeepGoing, layout, changes)
+}
+
+// runBuild builds the site. If filenames are given,
+// it only converts those and writes them to stdout.
+func runBuild(filenames []string) error {
+	site, err := loadSite(buildCmd)
+	if err != nil {
+		return err
+	}
+	if len(filenames) > 0 {
+		layout, err := site.layout()
+		if err != nil {
+			return err
+		}
+		for _, filename := range filenames {
+			HTML, err := mdFileToPage(filename, layout)
+			if err != nil {
+				return err
+			}
+			fmt.Println(HTML)
+		}
+		return nil
+	}
+
+	ignore, err := readIgnoreFile(ignoreFilename, defaultIgnore)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", ignoreFilename, err)
+	}
+	report, err := site.buildTree(ignore, nil)
+	if err != nil {
+		if report != nil {
+			fmt.Println(report.Summary())
+		}
+		return fmt.Errorf("build failed: %w", err)
+	}
+	if report.Failed() {
+		return fmt.Errorf("build failed: %s", report.Summary())
+	}
+	fmt.Printf("Complete: %s\n", report.Summary())
+	return nil
+}
+
+// mdFileToPage converts filename to a complete HTML document.
+func mdFileToPage(filename string, layout *pageLayout) (string, error) {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	front, body, err := splitFrontMatter(source)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", filename, err)
+	}
+	settings, err := newPageSettings(front)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", filename, err)
+	}
+	markdown, err := layout.markdown(settings)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", filename, err)
+	}
+	article, headings, err := mdToHTMLHeadings(body, markdown)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", filename, err)
+	}
+	return layout.apply(article, headings, filepath.ToSlash(filename), settings)
+}
+
+// runServe builds and serves the site until interrupted.
+func runServe(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("serve doesn't take filenames: %s", strings.Join(args, " "))
+	}
+	site, err := loadSite(serveCmd)
+	if err != nil {
+		return err
+	}
+	site.BaseURL = ""
+	// Catch problems with the templates right away.
+	if _, err := site.layout(); err != nil {
+		return err
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	// Changes to the config file take effect at the next build,
+	// except for the address, the quiet period and the template
+	// files watched, which need a restart.
+	build := func(ignore *ignoreRules, changes changeSet) (*buildReport, error) {
+		for _, ext := range configExtensions {
+			if _, ok := changes[filepath.Join(root, configName+ext)]; !ok {
+				continue
+			}
+			reloaded, err := loadSite(serveCmd)
+			if err != nil {
+				return nil, err
+			}
+			reloaded.BaseURL = ""
+			site = reloaded
+			// Every page depends on the settings.
+			changes = nil
+			break
+		}
+		return site.buildTree(ignore, changes)
+	}
+	// Ctrl+C or a termination signal stops the
+	// server after the current build finishes.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := serve(ctx, site.Addr, publishDir, site.templateFiles(), site.Quiet, build); err != nil {
+		return err
+	}
+	fmt.Println("Server stopped")
+	return nil
+}
+
+// runInit creates a new site from one of the starter kits.
+func runInit(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("init takes one directory, not %s", strings.Join(args, " "))
+	}
+	dir := *projectDir
+	if len(args) == 1 {
+		dir = args[0]
+	}
+	siteName := *initSiteName
+	if siteName == "" {
+		siteName = filepath.Base(dir)
+		if abs, err := filepath.Abs(dir); err == nil {
+			siteName = filepath.Base(abs)
+		}
+	}
+	created, err := scaffold(dir, *initTheme, siteName, *initForce)
+	if err != nil {
+		return err
+	}
+	for _, filename := range created {
+		fmt.Printf("Created %s\n", filename)
+	}
+	fmt.Printf("New site in %s. To see it, run:\n  %s -dir %s serve\n", dir, globalFlags.Name(), dir)
+	return nil
+}
+
+// runNew creates a Markdown file for each of filenames.
+// The page's title comes from its filename. Filenames
+// without an extension get .md added.
+func runNew(filenames []string) error {
+	if len(filenames) == 0 {
+		return errors.New("new needs at least one filename")
+	}
+	for _, filename := range filenames {
+		if filepath.Ext(filename) == "" {
+			filename += ".md"
+		}
+		if fileExists(filename) {
+			return fmt.Errorf("%s already exists", filename)
+		}
+		if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+			return err
+		}
+		// my-first-post.md is titled My first post
+		base := filepath.Base(filename)
+		title := strings.ReplaceAll(strings.TrimSuffix(base, filepath.Ext(base)), "-", " ")
+		if title != "" {
+			title = strings.ToUpper(title[:1]) + title[1:]
+		}
+		if err := writeStringToFile(filename, newPage(title, *newDraft)); err != nil {
+			return err
+		}
+		fmt.Printf("Created %s\n", filename)
+	}
+	return nil
+}
+
+// newPage returns the contents of a new Markdown page.
+func newPage(title string, draft bool) string {
+	front, _ := yaml.Marshal(map[string]interface{}{"title": title, "draft": draft})
+	return "---\n" + string(front) + "---\n# " + title + "\n"
+}
+
+// runClean removes the publish directory.
+func runClean(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("clean doesn't take filenames: %s", strings.Join(args, " "))
+	}
+	if !dirExists(publishDir) {
+		return nil
+	}
+	if err := os.RemoveAll(publishDir); err != nil {
+		return err
+	}
+	fmt.Printf("Removed %s\n", publishDir)
+	return nil
+}
+
+// runConfig runs config show, which lists every setting.
+func runConfig(args []string) error {
+	if len(args) != 1 || args[0] != "show" {
+		return fmt.Errorf("usage: %s config show [flags]", globalFlags.Name())
+	}
+	site, err := loadSite(configCmd)
+	if err != nil {
+		return err
+	}
+	site.show(os.Stdout)
+	return nil
+}
+
+// runHighlightCSS writes the stylesheet for the site's highlight
+// styles, light and dark, for pages using highlight-classes.
+func runHighlightCSS(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: %s highlight-css [flags] [output]", globalFlags.Name())
+	}
+	site, err := loadSite(highlightCSSCmd)
+	if err != nil {
+		return err
+	}
+	if err := site.Markdown.check(); err != nil {
+		return err
+	}
+	light, dark := site.Markdown.HighlightStyle, site.Markdown.HighlightDarkStyle
+	if light == "" {
+		return errors.New("no highlight style. Set markdown.highlight-style in the config file or use -markdown.highlight-style")
+	}
+	if len(args) == 0 {
+		return highlightCSS(os.Stdout, light, dark)
+	}
+	if err := writeFileAtomic(args[0], func(w io.Writer) error { return highlightCSS(w, light, dark) }); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote the stylesheet for %s to %s\n", light, args[0])
+	return nil
+}
+
+// runConvert converts the config file named first in args to
+// the file named second, in the format its extension calls for.
+// With no output file, -to gives the format and it goes to stdout.
+func runConvert(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: %s convert [flags] input [output]", globalFlags.Name())
+	}
+	input := args[0]
+	data, err := ioutil.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	from, err := formatOf(input, data)
+	if err != nil {
+		return err
+	}
+	var to configFormat
+	if *convertTo != "" {
+		if to, err = parseConfigFormat(*convertTo); err != nil {
+			return err
+		}
+	}
+	output := ""
+	if len(args) == 2 {
+		output = args[1]
+		format, ok := configFormats[strings.ToLower(filepath.Ext(output))]
+		if !ok {
+			return fmt.Errorf("%s: unknown config file extension. Use .toml, .yaml or .json", output)
+		}
+		if to != "" && to != format {
+			return fmt.Errorf("-to %s doesn't match %s", to, output)
+		}
+		to = format
+		if in, out := filepath.Clean(input), filepath.Clean(output); in == out {
+			return fmt.Errorf("%s would replace itself", input)
+		}
+	}
+	if to == "" {
+		return errors.New("name an output file, or use -to to choose a format")
+	}
+	converted, err := convertConfig(data, from, to, *convertLossy)
+	if err != nil {
+		return fmt.Errorf("%s: %w", input, err)
+	}
+	if output == "" {
+		_, err := os.Stdout.Write(converted)
+		return err
+	}
+	err = writeFileAtomic(output, func(w io.Writer) error {
+		_, err := w.Write(converted)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Converted %s to %s\n", input, output)
+	return nil
+}
+
+// SITE CONFIGURATION
+// Every setting for a site is in a Site. Each setting can come
+// from any of these places, and each one takes precedence over
+// the ones before it:
+//
+//   1. A built-in default
+//   2. The project's config file, microcms.toml, microcms.yaml
+//      or microcms.json
+//   3. A table in the config file named after the operating
+//      system, such as [darwin], [linux] or [windows]
+//   4. An environment variable named after the setting, so
+//      base-url is MICROCMS_BASE_URL
+//   5. The command-line flag, such as -base-url
+//
+// For example, this microcms.toml builds with 2 jobs on Windows:
+//
+//   name = "My site"
+//   styles = ["/assets/style.css"]
+//
+//   [windows]
+//   jobs = 2
+//
+// Settings in a table, such as hard-wraps in [markdown], are named
+// markdown.hard-wraps, so the flag is -markdown.hard-wraps and the
+// environment variable is MICROCMS_MARKDOWN_HARD_WRAPS.
+//
+// "microcms config show" lists every setting and where it came from.
+
+// The config file is this followed by one of configExtensions
+const configName = "microcms"
+
+// Format of the config file, by extension
+var configExtensions = []string{".toml", ".yaml", ".yml", ".json"}
+
+// Environment variables for settings start with this
+const envPrefix = "MICROCMS_"
+
+// Tables in the config file with these names hold settings for
+// a single operating system, as reported by runtime.GOOS.
+var operatingSystems = searchInfo{list: []string{"aix", "android", "darwin", "dragonfly", "freebsd", "illumos",
+	"ios", "js", "linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows"}}
+
+// Site holds the settings for a whole site. The config tag names
+// the setting in config files and flags, and the usage tag
+// describes it for help.
+type Site struct {
+	Name      string        `config:"name" usage:"Name of the site"`
+	Title     string        `config:"title" usage:"Contents of the HTML title tag (default: the page's first heading)"`
+	Language  string        `config:"language" usage:"HTML language designation, such as en or fr"`
+	Styles    []string      `config:"styles" usage:"One or more stylesheets (use quotes if more than one)"`
+	Templates []string      `config:"templates" usage:"One or more templates (use quotes if more than one)"`
+	BaseURL   string        `config:"base-url" usage:"URL the site is published at, such as https://example.com/docs/"`
+	Jobs      int           `config:"jobs" usage:"Number of files to convert at the same time"`
+	KeepGoing bool          `config:"keep-going" usage:"Build every file possible instead of stopping at the first error"`
+	Addr      string        `config:"addr" usage:"Address for serve to listen on"`
+	Quiet     time.Duration `config:"quiet" usage:"How long serve waits after a file changes for others to change before rebuilding"`
+	// How Markdown is converted, in the [markdown] table
+	Markdown markdownOptions `config:"markdown"`
+
+	// Config file the settings were read from, if any
+	configFile string
+	// Where each setting came from, by name
+	sources map[string]string
+}
+
+// defaultSite returns a Site with the built-in defaults.
+func defaultSite() *Site {
+	site := &Site{
+		Language: "en",
+		Jobs:     runtime.NumCPU(),
+		Addr:     "localhost:8080",
+		Quiet:    200 * time.Millisecond,
+		sources:  make(map[string]string),
+	}
+	for _, setting := range siteSettings() {
+		site.sources[setting.name] = "default"
+	}
+	return site
+}
+
+// siteSetting is a single setting in a Site.
+type siteSetting struct {
+	// Name in config files and flags. Settings in a group,
+	// such as markdown, are named group.setting, so the
+	// hard-wraps setting in [markdown] is markdown.hard-wraps.
+	name  string
+	usage string
+	// Where the setting is in Site, for FieldByIndex
+	index []int
+}
+
+// siteSettings returns every setting in a Site. A struct
+// field with a config tag is a group of settings.
+func siteSettings() []siteSetting {
+	return settingsOf(reflect.TypeOf(Site{}), "", nil)
+}
+
+// settingsOf returns the settings in the struct type t, whose
+// names start with prefix and which is at index in Site.
+func settingsOf(t reflect.Type, prefix string, index []int) (settings []siteSetting) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("config")
+		if name == "" {
+			continue
+		}
+		fieldIndex := append(append([]int{}, index...), i)
+		if field.Type.Kind() == reflect.Struct {
+			settings = append(settings, settingsOf(field.Type, prefix+name+".", fieldIndex)...)
+			continue
+		}
+		settings = append(settings, siteSetting{prefix + name, field.Tag.Get("usage"), fieldIndex})
+	}
+	return settings
+}
+
+// findSetting returns the setting name.
+func findSetting(name string) (siteSetting, bool) {
+	for _, setting := range siteSettings() {
+		if setting.name == name {
+			return setting, true
+		}
+	}
+	return siteSetting{}, false
+}
+
+// settingGroup returns the settings in the group name,
+// such as markdown. It's empty if there's no such group.
+func settingGroup(name string) (settings []siteSetting) {
+	for _, setting := range siteSettings() {
+		if strings.HasPrefix(setting.name, name+".") {
+			settings = append(settings, setting)
+		}
+	}
+	return settings
+}
+
+// siteFlags returns a flag set for the command name with a flag
+// for each of the settings named, or every setting if none are.
+// Naming a group, such as markdown, adds a flag for each
+// setting in it. Defaults shown in help are the built-in defaults.
+func siteFlags(name string, names ...string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	var settings []siteSetting
+	if len(names) == 0 {
+		settings = siteSettings()
+	}
+	for _, name := range names {
+		if setting, ok := findSetting(name); ok {
+			settings = append(settings, setting)
+		} else if group := settingGroup(name); len(group) > 0 {
+			settings = append(settings, group...)
+		} else {
+			panic("no setting named " + name)
+		}
+	}
+	defaults := reflect.ValueOf(defaultSite()).Elem()
+	for _, setting := range settings {
+		// Only flags that are given are used, by loadSite,
+		// so the values these return aren't needed.
+		switch value := defaults.FieldByIndex(setting.index).Interface().(type) {
+		case string:
+			fs.String(setting.name, value, setting.usage)
+		case []string:
+			fs.String(setting.name, strings.Join(value, " "), setting.usage)
+		case int:
+			fs.Int(setting.name, value, setting.usage)
+		case bool:
+			fs.Bool(setting.name, value, setting.usage)
+		case time.Duration:
+			fs.Duration(setting.name, value, setting.usage)
+		}
+	}
+	return fs
+}
+
+// loadSite reads the site's settings in the current directory,
+// which must already have been parsed from the command line by fs.
+func loadSite(fs *flag.FlagSet) (*Site, error) {
+	site := defaultSite()
+	if err := site.readConfigFile(); err != nil {
+		return nil, err
+	}
+	for _, setting := range siteSettings() {
+		env := envPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(setting.name))
+		if value, ok := os.LookupEnv(env); ok {
+			if err := site.set(setting.name, value, "$"+env); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		// Global flags, such as -dir, aren't settings.
+		if _, ok := findSetting(f.Name); ok && err == nil {
+			err = site.set(f.Name, f.Value.String(), "-"+f.Name)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return site, nil
+}
+
+// readConfigFile applies the settings in the project's config
+// file, if it has one, followed by those in the table for this
+// operating system.
+func (site *Site) readConfigFile() error {
+	for _, ext := range configExtensions {
+		filename := configName + ext
+		if !fileExists(filename) {
+			continue
+		}
+		if site.configFile != "" {
+			return fmt.Errorf("found both %s and %s. Remove one of them", site.configFile, filename)
+		}
+		site.configFile = filename
+	}
+	if site.configFile == "" {
+		return nil
+	}
+	settings := make(map[string]interface{})
+	if _, err := readConfig(site.configFile, &settings); err != nil {
+		return err
+	}
+
+	var platform map[string]interface{}
+	for key, value := range settings {
+		if !operatingSystems.Found(key) {
+			if err := site.set(key, value, site.configFile); err != nil {
+				return err
+			}
+			continue
+		}
+		table, err := configTable(value)
+		if err != nil {
+			return fmt.Errorf("%s: [%s] %w", site.configFile, key, err)
+		}
+		if key == runtime.GOOS {
+			platform = table
+			continue
+		}
+		// Catch mistakes in other operating systems' settings too.
+		for name, value := range table {
+			if err := defaultSite().set(name, value, fmt.Sprintf("%s [%s]", site.configFile, key)); err != nil {
+				return err
+			}
+		}
+	}
+	for key, value := range platform {
+		if err := site.set(key, value, fmt.Sprintf("%s [%s]", site.configFile, runtime.GOOS)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configTable returns value, a table from the config file, as a map.
+func configTable(value interface{}) (map[string]interface{}, error) {
+	if table, ok := value.(map[string]interface{}); ok {
+		return table, nil
+	}
+	return nil, fmt.Errorf("should be a table of settings, not %v", value)
+}
+
+// set changes the setting name to value, which came from source.
+// Values from environment variables and flags are always strings,
+// so a string is accepted for any setting. A string for a list
+// is space separated. If name is a group of settings, such as
+// markdown, value is a table of settings in it.
+func (site *Site) set(name string, value interface{}, source string) error {
+	setting, ok := findSetting(name)
+	if !ok {
+		if len(settingGroup(name)) == 0 {
+			return fmt.Errorf("%s: unknown setting %q", source, name)
+		}
+		table, err := configTable(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s %w", source, name, err)
+		}
+		for key, value := range table {
+			if err := site.set(name+"."+key, value, source); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if want := setValue(reflect.ValueOf(site).Elem().FieldByIndex(setting.index), value); want != "" {
+		return fmt.Errorf("%s: %s should be %s, not %v", source, name, want, value)
+	}
+	site.sources[name] = source
+	return nil
+}
+
+// setValue stores value in v, the field for a setting. If value
+// is the wrong type it returns what it should have been instead.
+func setValue(v reflect.Value, value interface{}) (want string) {
+	s, isString := value.(string)
+	switch v.Interface().(type) {
+	case string:
+		if !isString {
+			return "a string"
+		}
+		v.SetString(s)
+	case []string:
+		list := []string{}
+		switch value := value.(type) {
+		case string:
+			list = strings.Fields(value)
+		case []interface{}:
+			for _, item := range value {
+				s, ok := item.(string)
+				if !ok {
+					return "a list of strings"
+				}
+				list = append(list, s)
+			}
+		default:
+			return "a list of strings"
+		}
+		v.Set(reflect.ValueOf(list))
+	case int:
+		var n int64
+		switch value := value.(type) {
+		case int:
+			n = int64(value)
+		case int64:
+			n = value
+		case float64:
+			// JSON has no integers
+			if value != float64(int64(value)) {
+				return "a whole number"
+			}
+			n = int64(value)
+		case string:
+			var err error
+			if n, err = strconv.ParseInt(value, 10, 0); err != nil {
+				return "a whole number"
+			}
+		default:
+			return "a whole number"
+		}
+		v.SetInt(n)
+	case bool:
+		b, ok := value.(bool)
+		if isString {
+			var err error
+			b, err = strconv.ParseBool(s)
+			ok = err == nil
+		}
+		if !ok {
+			return "true or false"
+		}
+		v.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if !isString || err != nil {
+			return "a duration such as 500ms or 2s"
+		}
+		v.SetInt(int64(d))
+	}
+	return ""
+}
+
+// show writes every setting to w in TOML format,
+// each followed by a comment saying where it came from.
+func (site *Site) show(w io.Writer) {
+	if site.configFile != "" {
+		fmt.Fprintf(w, "# Config file: %s\n", site.configFile)
+	} else {
+		fmt.Fprintf(w, "# No config file. Create %s%s to add one.\n", configName, configExtensions[0])
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	v := reflect.ValueOf(site).Elem()
+	for _, setting := range siteSettings() {
+		name := setting.name
+		var value string
+		switch fv := v.FieldByIndex(setting.index).Interface().(type) {
+		case []string:
+			quoted := make([]string, len(fv))
+			for i, s := range fv {
+				quoted[i] = strconv.Quote(s)
+			}
+			value = "[" + strings.Join(quoted, ", ") + "]"
+		case string:
+			value = strconv.Quote(fv)
+		case time.Duration:
+			value = strconv.Quote(fv.String())
+		default:
+			value = fmt.Sprint(fv)
+		}
+		fmt.Fprintf(tw, "%s\t= %s\t# %s\n", name, value, site.sources[name])
+	}
+	tw.Flush()
+}
+
+// CONFIG FILES
+// Config files can be TOML, YAML or JSON. configcodec.go reads
+// and writes all three, and convert uses it to turn a config
+// file from one format into another.
+
+// MARKDOWN
+// How Markdown is converted can be changed for the whole site in
+// the [markdown] table of the config file, and for a single page
+// in its front matter, which takes precedence:
+//
+//   [markdown]
+//   table = true
+//   strikethrough = true
+//   highlight-style = "monokai"
+//
+//   ---
+//   markdown:
+//     hard-wraps: true
+//     highlight-style: ""
+//   ---
+//
+// Every option is off by default, which is goldmark's CommonMark
+// with nothing added. table, strikethrough, linkify and task-list
+// together are GitHub Flavored Markdown. The options are part of
+// the layout's key, so changing them converts the pages again.
+//
+// Highlighted code gets inline colors from highlight-style, unless
+// highlight-classes is set. Then it gets CSS classes, and
+//
+//   microcms highlight-css assets/highlight.css
+//
+// writes the stylesheet for them, using highlight-dark-style
+// instead when the browser prefers a dark color scheme.
+// A code fence can change line numbers and highlight lines
+// with options after its language:
+//
+//   ```go {linenos=true hl_lines=[2,4] linenostart=10}
+
+// markdownOptions and newMarkdown are in markdownpipeline.go.
+
+// highlightCSS writes the stylesheet for code highlighted with
+// classes in the chroma style light. If dark isn't empty, it's the
+// style used when the browser prefers a dark color scheme.
+//
+// chroma only writes a rule for a class if the style gives it a
+// color or font. So that nothing from the light style shows through,
+// the dark rules put back the default for anything the light rule
+// for the same class sets and the dark one doesn't.
+func highlightCSS(w io.Writer, light, dark string) error {
+	// Line numbers add rules for lines linked to with #.
+	formatter := chromahtml.New(chromahtml.WithClasses(true), chromahtml.WithLineNumbers(true))
+	var b bytes.Buffer
+	if err := formatter.WriteCSS(&b, styles.Get(light)); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "/* Highlighted code: %s */\n%s", light, b.String())
+	if dark == "" {
+		return nil
+	}
+	lightRules := cssRules(b.String())
+	b.Reset()
+	if err := formatter.WriteCSS(&b, styles.Get(dark)); err != nil {
+		return err
+	}
+	darkRules := cssRules(b.String())
+	fmt.Fprintf(w, "\n/* Highlighted code in dark mode: %s */\n@media (prefers-color-scheme: dark) {\n", dark)
+	for _, rule := range lightRules {
+		if _, ok := darkRules.find(rule.selector); !ok {
+			darkRules = append(darkRules, cssRule{rule.comment, rule.selector, nil})
+		}
+	}
+	for _, rule := range darkRules {
+		if lightRule, ok := lightRules.find(rule.selector); ok {
+			for _, property := range lightRule.properties {
+				name := strings.TrimSpace(strings.SplitN(property, ":", 2)[0])
+				if _, ok := rule.property(name); !ok {
+					rule.properties = append(rule.properties, name+": "+cssDefaults[name])
+				}
+			}
+		}
+		fmt.Fprintf(w, "  /* %s */ %s { %s }\n", rule.comment, rule.selector, strings.Join(rule.properties, "; "))
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
+
+// What each property chroma writes is set to when
+// a style doesn't say otherwise
+var cssDefaults = map[string]string{
+	"color":            "inherit",
+	"background-color": "transparent",
+	"font-weight":      "normal",
+	"font-style":       "normal",
+	"text-decoration":  "none",
+}
+
+// cssRule is a single rule in a stylesheet written by chroma.
+type cssRule struct {
+	comment    string
+	selector   string
+	properties []string
+}
+
+type cssRuleList []cssRule
+
+// chroma writes each rule on its own line, as
+// /* comment */ selector { property: value; ... }
+var cssRuleLine = regexp.MustCompile(`^/\* (.*?) \*/ (.+?) \{ (.*?);? \}$`)
+
+// cssRules returns the rules in css, a stylesheet written by chroma.
+func cssRules(css string) (rules cssRuleList) {
+	for _, line := range strings.Split(css, "\n") {
+		m := cssRuleLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		rule := cssRule{comment: m[1], selector: m[2]}
+		for _, property := range strings.Split(m[3], ";") {
+			if property = strings.TrimSpace(property); property != "" {
+				rule.properties = append(rule.properties, property)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// find returns the rule for selector.
+func (rules cssRuleList) find(selector string) (cssRule, bool) {
+	for _, rule := range rules {
+		if rule.selector == selector {
+			return rule, true
+		}
+	}
+	return cssRule{}, false
+}
+
+// property returns the value the rule gives the property name.
+func (rule cssRule) property(name string) (string, bool) {
+	for _, property := range rule.properties {
+		parts := strings.SplitN(property, ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == name {
+			return strings.TrimSpace(parts[1]), true
+		}
+	}
+	return "", false
+}
+
+// mdToHTML takes Markdown source as a byte slice and converts it to HTML
+// using Goldmark's default settings. Any front matter is left out.
+func mdToHTML(input []byte) ([]byte, error) {
+	_, body, err := splitFrontMatter(input)
+	if err != nil {
+		return []byte{}, err
+	}
+	HTML, _, err := mdToHTMLHeadings(body, newMarkdown(markdownOptions{}))
+	return HTML, err
+}
+
+// mdToHTMLHeadings converts input with markdown, and also
+// returns the document's headings. input must not have
+// front matter.
+func mdToHTMLHeadings(input []byte, markdown goldmark.Markdown) (HTML []byte, headings []Heading, err error) {
+	document := markdown.Parser().Parse(text.NewReader(input))
+	headings = documentHeadings(document, input)
+	var buf bytes.Buffer
+	if err := markdown.Renderer().Render(&buf, input, document); err != nil {
+		return []byte{}, nil, err
+	}
+	return buf.Bytes(), headings, nil
+}
+
+// TABLE OF CONTENTS
+// A layout can list a page's headings with {{ toc }}, or with
+// {{ toc 1 4 }} to choose the levels from <h1> to <h4>. With no
+// levels it uses the page's toc-min and toc-max front matter, or
+// 2 and 3. Front matter of toc: true puts the table of contents
+// at the start of the page and turns on markdown.auto-heading-ids,
+// so every heading can be linked to. Otherwise headings without
+// an id are listed without links.
+
+// tocFunc returns the toc template function for a page with
+// headings and front matter settings.
+func tocFunc(headings []Heading, settings pageSettings) func(levels ...int) (template.HTML, error) {
+	return func(levels ...int) (template.HTML, error) {
+		min, max := settings.tocLevels()
+		switch len(levels) {
+		case 0:
+		case 2:
+			min, max = levels[0], levels[1]
+		default:
+			return "", fmt.Errorf("toc takes a minimum and maximum level, or nothing, not %v", levels)
+		}
+		return template.HTML(tocHTML(headings, min, max)), nil
+	}
+}
+
+// noTOC stands in for toc when a layout is parsed,
+// before there's a page for it to list the headings of.
+func noTOC(levels ...int) (template.HTML, error) {
+	return "", errors.New("toc can only be used in a layout")
+}
+
+// LAYOUTS
+// When converting a whole tree each page is wrapped in a
+// complete HTML document. That's done either by assemble()
+// or by a user-supplied html/template file.
+
+// pageLayout turns a converted page into a complete HTML document.
+// It's shared by all the workers.
+type pageLayout struct {
+	// Template files from the command line. The first one is
+	// the default layout. The rest are parsed along with every
+	// layout so they can use what the files define.
+	// If it's empty assemble() is the default layout.
+	templates []string
+	// Name of the site, for layouts to show
+	name string
+	// Page title from the command line. If empty, each page
+	// uses its first heading instead.
+	title    string
+	language string
+	styles   []string
+	// Where the site is published. nil means the
+	// root of whatever domain it ends up on.
+	baseURL *url.URL
+	// How pages are converted unless their front matter
+	// says otherwise
+	options markdownOptions
+	// Identifies the command-line settings above.
+	key string
+
+	// Layouts are parsed the first time a page uses them.
+	// The map is keyed by the layout's filename as it appears
+	// in front matter, with "" for the default layout.
+	mu     sync.Mutex
+	parsed map[string]*parsedLayout
+	// Converters are made the first time a page uses their options.
+	converters map[markdownOptions]goldmark.Markdown
+}
+
+// parsedLayout is a single layout, ready to use.
+type parsedLayout struct {
+	// nil means assemble()
+	tmpl *template.Template
+	// Changes whenever the command-line settings or any of
+	// the layout's files change. A page has to be converted
+	// again when its layout's key changes.
+	key string
+	// Set if the layout couldn't be read or parsed
+	err error
+}
+
+// page is the data available to a layout template, for example
+// {{ .Title }}, {{ .Content }} or {{ .Site.Name }}.
+type page struct {
+	Site        pageSite
+	Title       string
+	Language    string
+	Stylesheets []string
+	// The converted Markdown
+	Content template.HTML
+	// Source file relative to the project root, using forward slashes
+	Source string
+	// Every heading in the page, in order
+	Headings []Heading
+	// What {{ toc }} returns
+	TOC template.HTML
+}
+
+// pageSite is what a layout template knows about the whole site.
+type pageSite struct {
+	Name string
+}
+
+// newLayout returns the layout used for every page. If templates
+// is empty the built-in assemble() shell is used. Otherwise the
+// first template file is the layout, and any others are parsed
+// along with it so the layout can use what they define.
+// Pages can name a different layout file in their front matter.
+// name is the name of the site, which layouts can show.
+// If baseURL isn't empty, it's where the site is published,
+// and links in every page are changed to suit. See rewriteURLs.
+// Pages are converted with options, which their front matter
+// can change.
+func newLayout(templates []string, name, title, language string, styles []string, baseURL string, options markdownOptions) (*pageLayout, error) {
+	if err := options.check(); err != nil {
+		return nil, err
+	}
+	l := &pageLayout{
+		name:       name,
+		title:      title,
+		language:   language,
+		styles:     styles,
+		options:    options,
+		parsed:     make(map[string]*parsedLayout),
+		converters: make(map[markdownOptions]goldmark.Markdown),
+	}
+	if baseURL != "" {
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("bad base URL: %w", err)
+		}
+		if u.Scheme != "" && u.Host == "" {
+			return nil, fmt.Errorf("base URL %s has no host", baseURL)
+		}
+		// The base URL is always a directory.
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		u.RawQuery, u.Fragment = "", ""
+		l.baseURL = u
+	}
+	// The build changes directory, so don't depend on this one.
+	for _, filename := range templates {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			return nil, err
+		}
+		l.templates = append(l.templates, abs)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "name=%q\ntitle=%q\nlanguage=%q\nstyles=%q\nbaseURL=%q\n", name, title, language, styles, baseURL)
+	fmt.Fprintf(h, "markdown=%+v\n", options)
+	l.key = hex.EncodeToString(h.Sum(nil))
+
+	// Catch problems with the default layout right away.
+	if p := l.lookup(""); p.err != nil {
+		return nil, p.err
+	}
+	return l, nil
+}
+
+// markdown returns the converter for a page whose front matter
+// is in settings. It can change the layout's options.
+func (l *pageLayout) markdown(settings pageSettings) (goldmark.Markdown, error) {
+	options, err := l.options.with(settings.Markdown)
+	if err != nil {
+		return nil, fmt.Errorf("front matter markdown: %w", err)
+	}
+	if settings.TOC {
+		// The table of contents links to every heading.
+		options.AutoHeadingIDs = true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	markdown, ok := l.converters[options]
+	if !ok {
+		markdown = newMarkdown(options)
+		l.converters[options] = markdown
+	}
+	return markdown, nil
+}
+
+// lookup returns the layout file named in a page's front matter,
+// or the default layout if name is empty. Relative names are
+// relative to the project root.
+func (l *pageLayout) lookup(name string) *parsedLayout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if p, ok := l.parsed[name]; ok {
+		return p
+	}
+	p := &parsedLayout{}
+	l.parsed[name] = p
+
+	files := l.templates
+	if name != "" {
+		files = []string{name}
+		if len(l.templates) > 1 {
+			files = append(files, l.templates[1:]...)
+		}
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "settings=%s\n", l.key)
+	if len(files) > 0 {
+		funcs := template.FuncMap{"absURL": l.absURL, "relURL": l.relURL, "toc": noTOC}
+		if p.tmpl, p.err = template.New(filepath.Base(files[0])).Funcs(funcs).ParseFiles(files...); p.err != nil {
+			return p
+		}
+		// Editing a template file changes every page that uses it.
+		for _, filename := range files {
+			b, err := ioutil.ReadFile(filename)
+			if err != nil {
+				p.err = err
+				return p
+			}
+			fmt.Fprintf(h, "template=%q\n%s\n", filename, b)
+		}
+	}
+	p.key = hex.EncodeToString(h.Sum(nil))
+	return p
+}
+
+// apply wraps the converted page article in a layout.
+// headings are the page's headings and source is
+// its filename relative to the project root.
+// Whatever the page's front matter in settings specifies
+// takes precedence over the command line.
+func (l *pageLayout) apply(article []byte, headings []Heading, source string, settings pageSettings) (string, error) {
+	p := l.lookup(settings.Layout)
+	if p.err != nil {
+		return "", p.err
+	}
+	title := settings.Title
+	if title == "" {
+		title = l.title
+	}
+	if title == "" && len(headings) > 0 {
+		title = headings[0].Text
+	}
+	if title == "" {
+		title = defaultTitle
+	}
+	language := settings.Language
+	if language == "" {
+		language = l.language
+	}
+	styles := settings.Stylesheets
+	if styles == nil {
+		styles = l.styles
+	}
+	min, max := settings.tocLevels()
+	contents := template.HTML(tocHTML(headings, min, max))
+	if settings.TOC {
+		article = append([]byte(contents), article...)
+	}
+	if p.tmpl == nil {
+		return l.rewriteURLs(assemble(string(article), title, language, styles)), nil
+	}
+	// A template can't be cloned once it's been executed,
+	// so the parsed one is only ever cloned.
+	tmpl, err := p.tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	tmpl.Funcs(template.FuncMap{"toc": tocFunc(headings, settings)})
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, page{
+		Site:        pageSite{Name: l.name},
+		Title:       title,
+		Language:    language,
+		Stylesheets: styles,
+		Content:     template.HTML(article),
+		Source:      source,
+		Headings:    headings,
+		TOC:         contents,
+	})
+	if err != nil {
+		return "", err
+	}
+	return l.rewriteURLs(buf.String()), nil
+}
+
+// BASE URL
+// Links and stylesheets are normally written relative to the
+// root of the site, like /about.html. That breaks when the site
+// is published somewhere other than the root of a domain, such
+// as https://example.com/docs/. So when there's a base URL,
+// root-relative URLs in pages are changed to start with its path.
+// Layouts can also use {{ absURL "about.html" }}, which gives
+// https://example.com/docs/about.html, or {{ relURL "about.html" }},
+// which gives /docs/about.html.
+
+// Tags with URLs to rewrite, and the attribute holding the URL
+var urlAttributes = map[string]string{
+	"a":      "href",
+	"link":   "href",
+	"img":    "src",
+	"script": "src",
+}
+
+var (
+	// An opening tag for one of urlAttributes. Markdown code
+	// is escaped by then, so it can't be mistaken for a tag.
+	urlTagPattern = regexp.MustCompile(`(?i)<(a|link|img|script)\b[^>]*>`)
+	// An attribute and its value, quoted or not
+	urlAttrPattern = regexp.MustCompile(`(?i)(\s)(href|src)(\s*=\s*)("[^"]*"|'[^']*'|[^\s"'>]+)`)
+)
+
+// basePath returns the path part of the base URL, which
+// always ends in a slash.
+func (l *pageLayout) basePath() string {
+	if l.baseURL == nil || l.baseURL.Path == "" {
+		return "/"
+	}
+	return l.baseURL.Path
+}
+
+// isAbsURL returns true for URLs that say where they
+// are on their own, like https://example.com/ or
+// //example.com/, and for ones like mailto:me@example.com
+// that aren't paths at all.
+func isAbsURL(s string) bool {
+	if strings.HasPrefix(s, "//") {
+		return true
+	}
+	u, err := url.Parse(s)
+	return err != nil || u.Scheme != ""
+}
+
+// relURL returns s as a path from the root of the domain.
+// s is relative to the root of the site, whether or not it
+// starts with a slash. URLs with a scheme or host, and
+// those that are only a #fragment, are returned unchanged.
+func (l *pageLayout) relURL(s string) string {
+	if isAbsURL(s) || strings.HasPrefix(s, "#") {
+		return s
+	}
+	return l.basePath() + strings.TrimPrefix(s, "/")
+}
+
+// absURL is like relURL, but includes the scheme and host
+// of the base URL if there is one.
+func (l *pageLayout) absURL(s string) string {
+	if isAbsURL(s) || strings.HasPrefix(s, "#") {
+		return s
+	}
+	rel := l.relURL(s)
+	if l.baseURL == nil || l.baseURL.Host == "" {
+		return rel
+	}
+	return l.baseURL.Scheme + "://" + l.baseURL.Host + rel
+}
+
+// rewriteURLs adds the base URL's path to root-relative URLs in the
+// a, link, img and script tags in document. Relative URLs like
+// about.html don't need it. Neither do URLs that already start with
+// the base path, for example because a layout used relURL.
+func (l *pageLayout) rewriteURLs(document string) string {
+	base := l.basePath()
+	if base == "/" {
+		return document
+	}
+	return urlTagPattern.ReplaceAllStringFunc(document, func(tag string) string {
+		name := strings.ToLower(urlTagPattern.FindStringSubmatch(tag)[1])
+		return urlAttrPattern.ReplaceAllStringFunc(tag, func(attr string) string {
+			m := urlAttrPattern.FindStringSubmatch(attr)
+			if !strings.EqualFold(m[2], urlAttributes[name]) {
+				return attr
+			}
+			value, quote := m[4], ""
+			if value[0] == '"' || value[0] == '\'' {
+				value, quote = value[1:len(value)-1], value[:1]
+			}
+			if !strings.HasPrefix(value, "/") || strings.HasPrefix(value, "//") || strings.HasPrefix(value, base) {
+				return attr
+			}
+			return m[1] + m[2] + m[3] + quote + base + value[1:] + quote
+		})
+	})
+}
+
+// FRONT MATTER
+// Pages can start with YAML front matter, in the same format
+// goldmark-meta reads (see App in mdcodeyamltemplate.go):
+//
+//   ---
+//   title: Release notes
+//   draft: true
+//   ---
+//
+// Keys are case insensitive. Anything microCMS doesn't
+// understand is ignored.
+
+// pageSettings holds the front matter values microCMS understands.
+type pageSettings struct {
+	Title    string
+	Language string
+	// nil unless the front matter lists stylesheets. An empty
+	// list means the page has none.
+	Stylesheets []string
+	// Template file to use instead of the default layout
+	Layout string
+	// Drafts aren't published
+	Draft bool
+	// Replaces the output filename, keeping its directory
+	Slug string
+	// Replaces the output path, relative to the publish directory
+	Permalink string
+	// Changes to the site's Markdown options. See markdownOptions.
+	Markdown map[string]interface{}
+	// Put a table of contents at the start of the page
+	TOC bool
+	// Levels of heading in the table of contents. 0 means the default.
+	TOCMin, TOCMax int
+}
+
+// splitFrontMatter separates the front matter at the start
+// of a Markdown document, delimited by lines containing only
+// ---, from the Markdown that follows it.
+// front is empty if there isn't any front matter.
+func splitFrontMatter(markdown []byte) (front map[string]interface{}, body []byte, err error) {
+	front = make(map[string]interface{})
+	line, rest := nextLine(markdown)
+	if !frontMatterDelimiter(line) {
+		return front, markdown, nil
+	}
+	start := len(markdown) - len(rest)
+	for len(rest) > 0 {
+		end := len(markdown) - len(rest)
+		line, rest = nextLine(rest)
+		if frontMatterDelimiter(line) {
+			if err = yaml.Unmarshal(markdown[start:end], &front); err != nil {
+				return nil, nil, err
+			}
+			return front, rest, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("front matter has no closing ---")
+}
+
+// nextLine returns the first line of b, without its newline,
+// and what follows it.
+func nextLine(b []byte) (line, rest []byte) {
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+// frontMatterDelimiter returns true if line starts or ends
+// front matter.
+func frontMatterDelimiter(line []byte) bool {
+	return string(bytes.TrimRight(line, " \t\r")) == "---"
+}
+
+// newPageSettings picks the values microCMS understands
+// out of a page's front matter.
+func newPageSettings(front map[string]interface{}) (s pageSettings, err error) {
+	for key, value := range front {
+		switch strings.ToLower(key) {
+		case "title":
+			s.Title, err = frontMatterString(key, value)
+		case "language", "lang":
+			s.Language, err = frontMatterString(key, value)
+		case "stylesheets", "styles":
+			s.Stylesheets, err = frontMatterStrings(key, value)
+		case "layout":
+			s.Layout, err = frontMatterString(key, value)
+		case "draft":
+			s.Draft, err = frontMatterBool(key, value)
+		case "slug":
+			s.Slug, err = frontMatterString(key, value)
+		case "permalink":
+			s.Permalink, err = frontMatterString(key, value)
+		case "markdown":
+			if s.Markdown, err = configTable(normalizeConfig(value)); err != nil {
+				err = fmt.Errorf("front matter %s %w", key, err)
+			}
+		case "toc":
+			s.TOC, err = frontMatterBool(key, value)
+		case "toc-min":
+			s.TOCMin, err = frontMatterLevel(key, value)
+		case "toc-max":
+			s.TOCMax, err = frontMatterLevel(key, value)
+		}
+		if err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// frontMatterString returns value as a string. Numbers and
+// booleans are allowed, so title: 1984 works.
+func frontMatterString(key string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case int, float64, bool:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("front matter %s should be a string, not %v", key, value)
+}
+
+// frontMatterStrings returns value as a list of strings.
+// It can be a YAML list or a string of space-separated items.
+func frontMatterStrings(key string, value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return []string{}, nil
+	case string:
+		return strings.Fields(v), nil
+	case []interface{}:
+		list := []string{}
+		for _, item := range v {
+			s, err := frontMatterString(key, item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("front matter %s should be a list, not %v", key, value)
+}
+
+// frontMatterLevel returns value as a heading level, 1 to 6.
+func frontMatterLevel(key string, value interface{}) (int, error) {
+	if level, ok := value.(int); ok && level >= 1 && level <= 6 {
+		return level, nil
+	}
+	return 0, fmt.Errorf("front matter %s should be a heading level from 1 to 6, not %v", key, value)
+}
+
+// tocLevels returns the levels of heading in the page's
+// table of contents.
+func (s pageSettings) tocLevels() (min, max int) {
+	min, max = defaultTOCMin, defaultTOCMax
+	if s.TOCMin != 0 {
+		min = s.TOCMin
+	}
+	if s.TOCMax != 0 {
+		max = s.TOCMax
+	}
+	return min, max
+}
+
+// frontMatterBool returns value as a boolean.
+func frontMatterBool(key string, value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b, nil
+		}
+	}
+	return false, fmt.Errorf("front matter %s should be true or false, not %v", key, value)
+}
+
+// output returns where the page goes, relative to the publish
+// directory and using forward slashes. rel is the source file's
+// directory relative to the project root and base is the name of
+// the HTML file it would get without any front matter.
+//
+// A permalink replaces the whole path, so /about/ becomes
+// about/index.html. A slug just replaces the filename, so
+// slug: hello turns blog/2023-05-01.md into blog/hello.html.
+func (s pageSettings) output(rel, base string) string {
+	if s.Permalink != "" {
+		// Cleaning it as an absolute path keeps it from
+		// climbing out of the publish directory.
+		p := path.Clean("/" + filepath.ToSlash(s.Permalink))
+		if strings.HasSuffix(s.Permalink, "/") || path.Ext(p) == "" {
+			p = path.Join(p, "index.html")
+		}
+		return strings.TrimPrefix(p, "/")
+	}
+	if slug := path.Base(path.Clean("/" + filepath.ToSlash(s.Slug))); s.Slug != "" && slug != "/" {
+		if path.Ext(slug) == "" {
+			slug += ".html"
+		}
+		base = slug
+	}
+	return path.Join(filepath.ToSlash(rel), base)
+}
+
+// route works out what happens to the Markdown file source, known
+// in the manifest as key. rel is its directory relative to the project
+// root and base is the name of the HTML file it would get without
+// front matter. If the file hasn't changed since the last build
+// the answer comes from the manifest. Otherwise its front matter is read.
+// Returns an entry with everything but the hash filled in.
+func (m *buildManifest) route(key, source, rel, base string) (entry manifestEntry, err error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return entry, &fileError{key, stepRead, err}
+	}
+	if prev, ok := m.Files[key]; ok && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()) {
+		return prev, nil
+	}
+	entry.Size = info.Size()
+	entry.ModTime = info.ModTime()
+	markdown, err := ioutil.ReadFile(source)
+	if err != nil {
+		return entry, &fileError{key, stepRead, err}
+	}
+	front, _, err := splitFrontMatter(markdown)
+	if err != nil {
+		return entry, &fileError{key, stepFrontMatter, err}
+	}
+	settings, err := newPageSettings(front)
+	if err != nil {
+		return entry, &fileError{key, stepFrontMatter, err}
+	}
+	entry.Draft = settings.Draft
+	entry.LayoutFile = settings.Layout
+	if !entry.Draft {
+		entry.Output = settings.output(rel, base)
+	}
+	return entry, nil
+}
+
+// mdFileToHTML converts a source file to an HTML string
+// using Goldmark's default settings.
+func mdFileToHTML(filename string) (string, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	if HTML, err := mdToHTML(bytes); err != nil {
+		return "", err
+	} else {
+		return string(HTML), nil
+	}
+}
+
+func quit(msg string, err error, exitCode int) {
+	if err != nil {
+		fmt.Printf("%s: %v\n", msg, err.Error())
+	} else {
+		fmt.Printf("%s\n", msg)
+	}
+	os.Exit(exitCode)
+}
+
+// mdDirectoryTreeToHTML takes startDir as the root directory,
+// converts all files (except those ignore matches) to HTML,
+// and deposits them in www. Attempts to create www if it
+// doesn't exist. www is expected to be a subdirectory of
+// startDir.
+//
+// Builds are incremental. A manifest stored in www records
+// the size, modification time, and content hash of every
+// source file from the previous build. Files whose output is
+// still current are skipped, and outputs whose source files
+// have since been deleted are removed.
+//
+// If changes isn't nil, it's what happened in the project since the
+// last build, and only the files in it are looked at. Everything
+// else keeps what the last build did with it. The whole tree is
+// built anyway if changes can't be handled on their own, for
+// example because a layout file or a directory changed.
+//
+// Each converted page is wrapped in layout. Front matter
+// can override the layout and the page's title, language and
+// stylesheets, as well as where its output goes. Drafts are skipped.
+//
+// Up to workers files are converted or copied at the same time.
+// A file that can't be built doesn't stop the others already
+// in progress, and if keepGoing is true the build continues
+// with every file it can. Either way the problem is recorded
+// in the report, which also counts what happened to each file.
+// err is only returned for problems that stop the build as a
+// whole, such as being unable to read the directory tree.
+func mdDirectoryTreeToHTML(startDir string, www string, ignore *ignoreRules, markdownExtensions searchInfo, workers int, keepGoing bool, layout *pageLayout, changes changeSet) (report *buildReport, err error) {
+
+	// Change to requested directory
+	if err = os.Chdir(startDir); err != nil {
+		return nil, fmt.Errorf("unable to change to directory %s: %w", startDir, err)
+	}
+
+	// Cache project's root directory
+	var currDir string
+	if currDir, err = os.Getwd(); err != nil {
+		return nil, fmt.Errorf("unable to get name of current directory: %w", err)
+	}
+
+	// Never treat the publish directory as source. Otherwise
+	// each build would copy the previous build's output
+	// into itself.
+	ignore = ignore.withOutput(www)
+
+	// Find out what the last build produced. If there's no
+	// manifest this is a full build.
+	previous := readManifest(filepath.Join(currDir, www))
+
+	// Collect all the files required for this project.
+	// ignore says which files not to process. If only
+	// some of them changed, just collect those.
+	var files []string
+	var changed map[string]change
+	partial := false
+	if changes != nil {
+		changed, partial = changes.keys(currDir, ignore, previous, layout)
+	}
+	if partial {
+		for key, c := range changed {
+			if c != changeRemoved {
+				files = append(files, filepath.FromSlash(key))
+			}
+		}
+		sort.Strings(files)
+	} else if files, err = getProjectTree(".", ignore); err != nil {
+		return nil, fmt.Errorf("unable to get directory tree: %w", err)
+	}
+
+	// Make sure there's a place to put the output.
+	if err = os.MkdirAll(filepath.Join(currDir, www), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("unable to create directory %s: %w", www, err)
+	}
+
+	// Record of this build, written out when it's done.
+	manifest := newManifest()
+
+	// Problems found before any work is handed out
+	var routeErrors []*fileError
+
+	// Now have list of all files in directory tree.
+	// If markdown, convert to HTML and copy that file to the HTML publication directory.
+	// If not, copy to target publication directory unchanged.
+	// Working out where each file goes is quick, so that's
+	// done here. The slow part is left to the workers.
+	var jobs []buildJob
+
+	// Maps each output file to its position in jobs.
+	claimed := make(map[string]int)
+
+	// Every source file in the tree except drafts
+	inTree := make(map[string]bool)
+
+	// Relative directory of file. Required to determine where
+	// to copy target file.
+	var rel string
+
+	// Main loop. Traverse the list of files to be copied.
+	// If a file is Markdown as determined by its file extension,
+	// it will be converted to HTML and copied to output directory.
+	// If a file isn't Markdown, it will be copied to output directory
+	// with no processing.
+	for _, filename := range files {
+
+		var job buildJob
+
+		// Name of the file relative to the project root, which
+		// is how it's known in the manifest.
+		job.key = filepath.ToSlash(filename)
+
+		// Get the fully qualified pathname for this file.
+		job.source = filepath.Join(currDir, filename)
+
+		// Separate out the file's origin directory
+		sourceDir := filepath.Dir(job.source)
+
+		// Get the relatve directory. For example, if your directory
+		// is ~/raj/blog and you're in ~/raj/blog/2023/may, then
+		// the relative directory is 2023/may.
+		if rel, err = filepath.Rel(currDir, sourceDir); err != nil {
+			return nil, fmt.Errorf("unable to get relative paths of %s and %s: %w", job.source, www, err)
+		}
+		// The content directory is the top of the site.
+		rel = publishedDir(rel)
+
+		// Obtain file extension.
+		ext := path.Ext(job.source)
+		// Replace converted filename extension, from markdown to HTML.
+		// Only convert to HTML if it has a Markdown extension.
+		base := filepath.Base(job.source)
+		job.output = path.Join(filepath.ToSlash(rel), base)
+		if markdownExtensions.Found(ext) {
+			// Strip origal file's Markdown extension and make
+			// the destination files' extension HTML
+			base = base[0:len(base)-len(ext)] + ".html"
+			job.convert = true
+			job.layout = layout
+
+			// Front matter can move the output or
+			// keep the page from being published at all.
+			entry, err := previous.route(job.key, job.source, rel, base)
+			if err != nil {
+				routeErrors = append(routeErrors, err.(*fileError))
+				// Leave the last build's output alone.
+				inTree[job.key] = true
+				continue
+			}
+			if entry.Draft {
+				// Not part of the site, so any output from
+				// before it was a draft gets removed.
+				manifest.Files[job.key] = entry
+				continue
+			}
+			job.output = entry.Output
+			job.layoutFile = entry.LayoutFile
+			p := layout.lookup(job.layoutFile)
+			if p.err != nil {
+				routeErrors = append(routeErrors, &fileError{job.key, stepLayout, p.err})
+				inTree[job.key] = true
+				continue
+			}
+			// Changing the layout changes the page.
+			job.layoutKey = p.key
+			job.rebuild = previous.Files[job.key].Layout != p.key
+		}
+
+		// Determine the destination directory. If the base publish
+		// directory is named WWW, then in the previous example
+		// it would be ~/raj/blog/WWW, or ~/raj/blog/WWW/2023/may
+		job.target = filepath.Join(currDir, www, filepath.FromSlash(job.output))
+		job.targetDir = filepath.Dir(job.target)
+		inTree[job.key] = true
+
+		// Two source files can produce the same output, for
+		// example foo.md and foo.html. The one processed last
+		// would win in a one-at-a-time build, so the same
+		// goes here. Otherwise the result would depend on
+		// which worker happened to finish first. The other
+		// one failed, since its output isn't in the site.
+		if i, ok := claimed[job.target]; ok {
+			routeErrors = append(routeErrors, &fileError{jobs[i].key, stepOutput,
+				fmt.Errorf("%s produces %s too, and is used instead", job.key, job.output)})
+			jobs[i] = job
+			continue
+		}
+		claimed[job.target] = len(jobs)
+		jobs = append(jobs, job)
+	}
+
+	if partial {
+		// The files the last build knew about that haven't changed
+		// are still part of the site. If a changed file now produces
+		// the same output as one of them, which one wins depends on
+		// the order of the whole tree, so build all of it.
+		for key, entry := range previous.Files {
+			if _, ok := changed[key]; ok {
+				continue
+			}
+			target := filepath.Join(currDir, www, filepath.FromSlash(entry.Output))
+			if _, ok := claimed[target]; ok {
+				return mdDirectoryTreeToHTML(currDir, www, ignore, markdownExtensions, workers, keepGoing, layout, nil)
+			}
+			inTree[key] = true
+		}
+	}
+
+	// Unless asked to keep going, the first error stops the build.
+	if len(routeErrors) > 0 && !keepGoing {
+		jobs = nil
+	}
+	report = runBuildJobs(jobs, workers, keepGoing, previous, manifest)
+	report.Errors = append(report.Errors, routeErrors...)
+
+	// Files that failed, or that the build never got to
+	// because of an earlier failure, keep whatever the last
+	// build recorded for them. Their old output is still there.
+	previous.keep(manifest, inTree)
+
+	// Anything the last build produced that isn't part of
+	// this one is now stale. Either its source file no longer
+	// exists, or its front matter sent it somewhere else.
+	var removeErrors []*fileError
+	report.removed, removeErrors = previous.removeStale(manifest, filepath.Join(currDir, www))
+	report.Errors = append(report.Errors, removeErrors...)
+	report.sortErrors()
+
+	if err = manifest.write(filepath.Join(currDir, www)); err != nil {
+		return report, fmt.Errorf("unable to write build manifest: %w", err)
+	}
+	return report, nil
+}
+
+// DEVELOPMENT SERVER
+// The serve command builds the site, then serves the publish
+// directory over HTTP. When a source file changes the site is
+// built again, which only redoes the files affected, and every
+// open browser tab reloads itself.
+
+// Browsers listen for reload messages at this URL.
+const reloadPath = "/_microcms/reload"
+
+// How often the watcher checks whether a deleted
+// file or directory it was watching has come back.
+const watchRetryInterval = time.Second
+
+// liveReloadScript is added to every HTML page the server sends.
+// It reloads the page whenever the server says to, using
+// server-sent events. EventSource reconnects by itself if
+// the server restarts.
+const liveReloadScript = `<script>
+new EventSource("` + reloadPath + `").onmessage = function () { location.reload(); };
+</script>
+`
+
+// serve builds the site using build, then serves www at addr
+// until ctx is done or the server fails. Source files in the current directory,
+// except www and anything the ignore file matches, are watched,
+// as are the template files, the layouts directory, the ignore
+// file and the config file. The ignore file is read again whenever
+// it changes. Changes are collected until none have happened for
+// the quiet period, then passed to build as a single change set,
+// followed by a reload of each connected browser. The first build
+// gets a nil change set, as does the one after the ignore file
+// changes, meaning everything is built.
+func serve(ctx context.Context, addr string, www string, templates []string, quiet time.Duration, build func(ignore *ignoreRules, changes changeSet) (*buildReport, error)) error {
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	ignore, err := readIgnoreFile(ignoreFilename, defaultIgnore)
+	if err != nil {
+		return err
+	}
+	// The ignore file, the config file and the layouts
+	// usually aren't part of the site, but changes to
+	// them still need watching.
+	settingsFiles := map[string]bool{filepath.Join(root, ignoreFilename): true}
+	for _, ext := range configExtensions {
+		settingsFiles[filepath.Join(root, configName+ext)] = true
+	}
+	for _, filename := range templates {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			return err
+		}
+		settingsFiles[abs] = true
+	}
+	layoutDir := filepath.Join(root, filepath.Dir(defaultLayoutFile))
+	// The watcher's goroutine reads ignore
+	// while the build goroutine may replace it.
+	var ignoreMu sync.Mutex
+	ignored := func(filename string, isDir bool) bool {
+		if settingsFiles[filename] || filename == layoutDir || strings.HasPrefix(filename, layoutDir+string(filepath.Separator)) {
+			return false
+		}
+		ignoreMu.Lock()
+		defer ignoreMu.Unlock()
+		return ignore.IgnoredPath(root, filename, isDir)
+	}
+
+	reloads := newReloader()
+	rebuild := func(changes changeSet) {
+		ignoreMu.Lock()
+		current := ignore
+		ignoreMu.Unlock()
+		report, err := build(current, changes)
+		if report != nil {
+			fmt.Println(report.Summary())
+		}
+		if err != nil {
+			fmt.Printf("Build failed: %v\n", err)
+			return
+		}
+		reloads.reload()
+	}
+	rebuild(nil)
+
+	w := watcher.New()
+	w.FilterOps(watcher.Create, watcher.Write, watcher.Remove, watcher.Rename, watcher.Move)
+	// The build writes to www. Watching it would mean every
+	// build causes another one, so it's ignored whatever
+	// the ignore file says.
+	ignore = ignore.withOutput(www)
+	if err := w.Ignore(www); err != nil {
+		return err
+	}
+	// Don't even watch ignored files.
+	w.AddFilterHook(func(info os.FileInfo, fullPath string) error {
+		if ignored(fullPath, info.IsDir()) {
+			return watcher.ErrSkip
+		}
+		return nil
+	})
+
+	// Stopping the server stops the watcher too.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Templates named on the command line can be
+	// outside the project.
+	paths := append([]string{"."}, templates...)
+	events := make(chan watcher.Event)
+	watchErr := make(chan error, 1)
+	go func() {
+		defer close(events)
+		watchErr <- watchTree(ctx, w, paths, time.Millisecond*100,
+			func(event watcher.Event) { events <- event },
+			func(err error) { fmt.Printf("Watcher: %v\n", err) })
+	}()
+
+	changes := make(chan changeSet)
+	go debounce(events, quiet, func(filename string, isDir bool) bool {
+		return !ignored(filename, isDir)
+	}, changes)
+	// Closed once the last build is done
+	built := make(chan struct{})
+	go func() {
+		defer close(built)
+		for c := range changes {
+			fmt.Print(c)
+			if _, ok := c[filepath.Join(root, ignoreFilename)]; ok {
+				if reread, err := readIgnoreFile(ignoreFilename, defaultIgnore); err != nil {
+					fmt.Printf("Unable to read %s: %v\n", ignoreFilename, err)
+				} else {
+					ignoreMu.Lock()
+					ignore = reread.withOutput(www)
+					ignoreMu.Unlock()
+				}
+				// Files may have joined or left the site.
+				c = nil
+			}
+			rebuild(c)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle(reloadPath, reloads)
+	mux.Handle("/", liveReloadHandler(www))
+	server := &http.Server{Addr: addr, Handler: mux}
+	// Browsers waiting for a reload would
+	// otherwise keep the server from stopping.
+	server.RegisterOnShutdown(reloads.close)
+	serverErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("Serving %s at http://%s\n", www, addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case <-ctx.Done():
+		fmt.Println("Shutting down")
+	case err = <-serverErr:
+	case err = <-watchErr:
+	}
+	cancel()
+	shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	if shutdownErr := server.Shutdown(shutdownCtx); err == nil {
+		err = shutdownErr
+	}
+	<-built
+	return err
+}
+
+// watchTree watches each of paths, and everything under them, with
+// w until ctx is done, checking for changes every interval. Each
+// change is passed to onEvent. Errors are passed to onError, and
+// watching carries on. If a watched path is deleted, watchTree waits
+// for it to come back and watches it again, reporting it as created.
+// watchTree returns after closing w, once ctx is done, or if w
+// can't be started.
+func watchTree(ctx context.Context, w *watcher.Watcher, paths []string, interval time.Duration, onEvent func(watcher.Event), onError func(error)) error {
+	// Paths waiting to come back, by full path
+	missing := make(map[string]bool)
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		if err := w.AddRecursive(abs); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			onError(fmt.Errorf("%s doesn't exist. Waiting for it", p))
+			missing[abs] = true
+		}
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		started <- w.Start(interval)
+	}()
+	retry := time.NewTicker(watchRetryInterval)
+	defer retry.Stop()
+
+	for {
+		select {
+		case event := <-w.Event:
+			onEvent(event)
+		case err := <-w.Error:
+			if err != watcher.ErrWatchedFileDeleted {
+				onError(err)
+				continue
+			}
+			// The watcher doesn't say which one.
+			for _, p := range paths {
+				abs, _ := filepath.Abs(p)
+				if _, err := os.Stat(abs); err != nil && !missing[abs] {
+					onError(fmt.Errorf("%s was deleted. Waiting for it to come back", p))
+					missing[abs] = true
+				}
+			}
+		case <-retry.C:
+			for abs := range missing {
+				info, err := os.Stat(abs)
+				if err != nil {
+					continue
+				}
+				if err := w.AddRecursive(abs); err != nil {
+					onError(err)
+					continue
+				}
+				delete(missing, abs)
+				onEvent(watcher.Event{Op: watcher.Create, Path: abs, OldPath: abs, FileInfo: info})
+			}
+		case err := <-started:
+			// Start only returns this early if it failed.
+			return err
+		case <-ctx.Done():
+			return closeWatcher(w, started, onEvent, onError)
+		}
+	}
+}
+
+// closeWatcher stops w and waits for it to finish. Events and
+// errors are still passed along in the meantime, because the
+// watcher can't notice it's being closed while it waits for
+// someone to take them.
+func closeWatcher(w *watcher.Watcher, started <-chan error, onEvent func(watcher.Event), onError func(error)) error {
+	// Close does nothing unless the watcher has started, so wait
+	// for it to. But if Start has already failed it never will.
+	running := make(chan struct{})
+	go func() {
+		w.Wait()
+		close(running)
+	}()
+	select {
+	case err := <-started:
+		return err
+	case <-running:
+	}
+	go w.Close()
+	for {
+		select {
+		case event := <-w.Event:
+			onEvent(event)
+		case err := <-w.Error:
+			onError(err)
+		case <-w.Closed:
+			return <-started
+		}
+	}
+}
+
+// liveReloadHandler serves the files in www, adding
+// liveReloadScript to each HTML page.
+func liveReloadHandler(www string) http.Handler {
+	files := http.FileServer(http.Dir(www))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := filepath.Join(www, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		// Directory URLs ending in a slash get their index.html.
+		// Without the slash the file server redirects to add it.
+		if strings.HasSuffix(r.URL.Path, "/") {
+			name = filepath.Join(name, "index.html")
+		}
+		if filepath.Ext(name) != ".html" {
+			files.ServeHTTP(w, r)
+			return
+		}
+		info, err := os.Stat(name)
+		if err != nil || info.IsDir() {
+			files.ServeHTTP(w, r)
+			return
+		}
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(injectScript(b, liveReloadScript)))
+	})
+}
+
+// injectScript inserts script just before the closing body tag
+// of an HTML document, or at the end if there isn't one.
+func injectScript(document []byte, script string) []byte {
+	i := bytes.LastIndex(bytes.ToLower(document), []byte("</body>"))
+	if i < 0 {
+		return append(document, script...)
+	}
+	b := make([]byte, 0, len(document)+len(script))
+	b = append(b, document[:i]...)
+	b = append(b, script...)
+	return append(b, document[i:]...)
+}
+
+// reloader tells every connected browser to reload.
+type reloader struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]bool
+	// Closed when the server shuts down
+	done chan struct{}
+	once sync.Once
+}
+
+func newReloader() *reloader {
+	return &reloader{
+		clients: make(map[chan struct{}]bool),
+		done:    make(chan struct{}),
+	}
+}
+
+// close ends every connection.
+func (rl *reloader) close() {
+	rl.once.Do(func() { close(rl.done) })
+}
+
+// reload sends a reload message to every connected browser.
+func (rl *reloader) reload() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for ch := range rl.clients {
+		// A client that already has a reload
+		// waiting doesn't need another one.
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ServeHTTP keeps a server-sent events connection
+// open to a browser until it goes away.
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan struct{}, 1)
+	rl.mu.Lock()
+	rl.clients[ch] = true
+	rl.mu.Unlock()
+	defer func() {
+		rl.mu.Lock()
+		delete(rl.clients, ch)
+		rl.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// A comment, which the browser ignores, so it
+	// knows the connection is open.
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+	for {
+		select {
+		case <-ch:
+			fmt.Fprint(w, "data: reload\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-rl.done:
+			return
+		}
+	}
+}
+
+// CHANGE SETS
+// Saving a file in an editor often means writing a temporary
+// file, renaming it over the original, and then touching it.
+// Each step is a separate watcher event. Rebuilding for every
+// one would be a waste, so events are collected until things
+// go quiet, and then handed over as a single set of changes.
 
-func main() {
-	var styles string
-	flag.StringVar(&styles, "styles", "", "One or more stylesheets (use quotes if more than one)")
+// change is what happened to a file, taking
+// all the events for it together.
+type change int
 
-	var templs string
-	flag.StringVar(&templs, "templates", "", "One or more templates (use quotes if more than one)")
+const (
+	changeCreated change = iota
+	changeModified
+	changeRemoved
+)
 
-	var title string
-	flag.StringVar(&title, "title", "powered by microCMS", "Contents of the HTML title tag")
+func (c change) String() string {
+	switch c {
+	case changeCreated:
+		return "created"
+	case changeModified:
+		return "modified"
+	}
+	return "removed"
+}
 
-	var language string
-	flag.StringVar(&language, "language", "en", "HTML language designation, such as en or fr")
+// changeSet is the net change to each file, keyed by full path.
+// A file created and then removed isn't in it at all.
+type changeSet map[string]change
 
-	flag.Parse()
-	filename := flag.Arg(0)
+// add merges a watcher event into the set. Paths for
+// which keep returns false are left out.
+func (c changeSet) add(event watcher.Event, keep func(filename string, isDir bool) bool) {
+	isDir := event.FileInfo != nil && event.IsDir()
+	switch event.Op {
+	case watcher.Create:
+		c.merge(event.Path, isDir, changeCreated, keep)
+	case watcher.Write, watcher.Chmod:
+		// A directory is written to whenever a file in it
+		// is created or removed, which is reported anyway.
+		if isDir {
+			return
+		}
+		c.merge(event.Path, isDir, changeModified, keep)
+	case watcher.Remove:
+		c.merge(event.Path, isDir, changeRemoved, keep)
+	case watcher.Rename, watcher.Move:
+		// The same as removing the old file and
+		// creating the new one.
+		c.merge(event.OldPath, isDir, changeRemoved, keep)
+		c.merge(event.Path, isDir, changeCreated, keep)
+	}
+}
 
-	stylesheets := strings.Split(styles, " ")
-	//templates := strings.Split(templs, ", ")
-	//fmt.Printf("Filename: %v\nStylesheets: %v\nTemplates: %v\nTitle: %v", filename, stylesheets, templates, title)
+// merge combines what already happened to filename with what
+// just happened to it.
+func (c changeSet) merge(filename string, isDir bool, next change, keep func(filename string, isDir bool) bool) {
+	if !keep(filename, isDir) {
+		return
+	}
+	prev, ok := c[filename]
+	switch {
+	case !ok:
+		c[filename] = next
+	case prev == changeCreated && next == changeRemoved:
+		// It's as if it never existed.
+		delete(c, filename)
+	case prev == changeCreated:
+		// Still new, however often it's written to.
+	case prev == changeRemoved && next == changeCreated:
+		// Replaced, for example by renaming a temporary file.
+		c[filename] = changeModified
+	default:
+		c[filename] = next
+	}
+}
 
-	var exclude searchInfo
-	exclude.list = []string{"node_modules", "main.bak", ".git", "pub", ".DS_Store", ".gitignore"}
+// String lists the changes one per line, sorted by path.
+func (c changeSet) String() string {
+	filenames := make([]string, 0, len(c))
+	for filename := range c {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	var b strings.Builder
+	for _, filename := range filenames {
+		fmt.Fprintf(&b, "%s %s\n", c[filename], filename)
+	}
+	return b.String()
+}
 
-	var markdownExtensions searchInfo
-	markdownExtensions.list = []string{".md", ".mkd", ".mdwn", ".mdown", ".mdtxt", ".mdtext", ".markdown"}
+// keys returns the changes in c that matter to the build, keyed
+// by the names the manifest uses for the files: relative to root,
+// with forward slashes. ok is false if the whole tree has to be built
+// instead, because a file used by the layouts changed, or a directory
+// did, or something outside root that isn't a template.
+// previous is the last build's manifest, and knows which layouts
+// pages asked for in their front matter.
+func (c changeSet) keys(root string, ignore *ignoreRules, previous *buildManifest, layout *pageLayout) (keys map[string]change, ok bool) {
+	layoutFiles := make(map[string]bool)
+	for _, filename := range layout.templates {
+		layoutFiles[filename] = true
+	}
+	for _, entry := range previous.Files {
+		switch {
+		case entry.LayoutFile == "":
+		case filepath.IsAbs(entry.LayoutFile):
+			layoutFiles[entry.LayoutFile] = true
+		default:
+			layoutFiles[filepath.Join(root, entry.LayoutFile)] = true
+		}
+	}
+	layoutDir := filepath.Join(root, filepath.Dir(defaultLayoutFile))
 
-	mdDirectoryTreeToHTML(".", "WWW", exclude, markdownExtensions)
-	quit("Complete. Check remaining code.", nil, 0)
+	keys = make(map[string]change)
+	for filename, what := range c {
+		if layoutFiles[filename] || strings.HasPrefix(filename, layoutDir+string(filepath.Separator)) {
+			return nil, false
+		}
+		rel, err := filepath.Rel(root, filename)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, false
+		}
+		key := filepath.ToSlash(rel)
+		if what != changeRemoved {
+			info, err := os.Stat(filename)
+			switch {
+			case err != nil:
+				// Gone again since.
+				what = changeRemoved
+			case info.IsDir():
+				// A directory renamed into place
+				// comes with files of its own.
+				return nil, false
+			case ignore.Ignored(rel, false):
+				continue
+			}
+		}
+		if what == changeRemoved {
+			if _, ok := previous.Files[key]; !ok {
+				// Either it never made it into the site,
+				// or it was a directory full of files.
+				for known := range previous.Files {
+					if strings.HasPrefix(known, key+"/") {
+						return nil, false
+					}
+				}
+				continue
+			}
+		}
+		keys[key] = what
+	}
+	return keys, true
+}
 
-	if HTML, err := mdFileToHTML(filename); err != nil {
-		quit("Error creating Markdown file", err, 1)
-	} else {
-		assemble(HTML, title, language, stylesheets)
-		//fmt.Println(HTML)
-		quit("Complete", nil, 0)
+// debounce collects events into a change set, sending it
+// to changes once quiet has passed with no more events. Only
+// paths for which keep returns true are included, and empty sets
+// aren't sent. Events keep being collected while the receiver is
+// busy, so it gets everything that happened in the meantime as
+// one set. changes is closed when events is.
+func debounce(events <-chan watcher.Event, quiet time.Duration, keep func(filename string, isDir bool) bool, changes chan<- changeSet) {
+	defer close(changes)
+	pending := make(changeSet)
+	timer := time.NewTimer(quiet)
+	timer.Stop()
+	// Set to changes when pending is ready to send, nil otherwise.
+	// Sending on a nil channel blocks forever, so it's left out
+	// of the select below until then.
+	var out chan<- changeSet
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			pending.add(event, keep)
+			// Wait for things to go quiet again.
+			out = nil
+			timer.Stop()
+			timer.Reset(quiet)
+		case <-timer.C:
+			if len(pending) > 0 {
+				out = changes
+			}
+		case out <- pending:
+			pending = make(changeSet)
+			out = nil
+		}
 	}
+}
 
+// publishedDir returns where in the publish directory files
+// from the project directory rel go. That's the same place,
+// except for the content directory, which is the top of the site.
+func publishedDir(rel string) string {
+	slashed := filepath.ToSlash(rel)
+	if slashed == contentDir {
+		return "."
+	}
+	if strings.HasPrefix(slashed, contentDir+"/") {
+		return filepath.FromSlash(strings.TrimPrefix(slashed, contentDir+"/"))
+	}
+	return rel
 }
 
-// mdToHTML takes Markdown source as a byte slice and converts it to HTML
-// using Goldmark's default settings.
-func mdToHTML(input []byte) ([]byte, error) {
+// STARTER KITS
+// init creates a site by copying one of the starter kits
+// embedded here. Each is a directory in starters named for
+// its theme. Files ending in .tmpl are text/templates, with
+// [[ and ]] as delimiters so they can contain html/templates.
+// They're executed with the data in starterData, and saved
+// without the .tmpl. A value going into the config file or
+// front matter has to be quoted the way TOML or YAML needs,
+// which [[toml .SiteName]] and [[yaml .SiteName]] do.
+// Every kit has content, layouts, shortcodes and assets
+// directories. Pages aren't templates, so build doesn't run
+// shortcodes yet. The shortcodes directory is where they go,
+// in the form shortcode.go reads, and it's left out of the site.
+
+// A populated subdirectory named starters is required
+//
+//go:embed all:starters
+var starterFiles embed.FS
+
+// starterData is what the .tmpl files in a starter kit can use.
+type starterData struct {
+	SiteName string
+}
+
+// starterFuncs are the functions the .tmpl files in a starter kit can use.
+var starterFuncs = texttemplate.FuncMap{
+	"toml": tomlValue,
+	"yaml": yamlValue,
+}
+
+// tomlValue returns value as it's written in a TOML file.
+func tomlValue(value interface{}) (string, error) {
 	var buf bytes.Buffer
-	if err := goldmark.Convert(input, &buf); err != nil {
-		return []byte{}, err
+	if err := toml.NewEncoder(&buf).Encode(map[string]interface{}{"v": value}); err != nil {
+		return "", err
 	}
-	return buf.Bytes(), nil
+	return strings.TrimSuffix(strings.TrimPrefix(buf.String(), "v = "), "\n"), nil
 }
 
-// mdFileToHTML converts a source file to an HTML string
-// using Goldmark's default settings.
-func mdFileToHTML(filename string) (string, error) {
-	bytes, err := ioutil.ReadFile(filename)
+// yamlValue returns value as a quoted YAML string on one line.
+func yamlValue(value string) (string, error) {
+	b, err := yamlv3.Marshal(&yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: value, Style: yamlv3.DoubleQuotedStyle})
 	if err != nil {
 		return "", err
 	}
-	if HTML, err := mdToHTML(bytes); err != nil {
-		return "", err
-	} else {
-		return string(HTML), nil
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
+
+// starterThemes returns the name of every starter kit.
+func starterThemes() []string {
+	var themes []string
+	entries, _ := fs.ReadDir(starterFiles, "starters")
+	for _, entry := range entries {
+		if entry.IsDir() {
+			themes = append(themes, entry.Name())
+		}
 	}
+	return themes
 }
 
-func quit(msg string, err error, exitCode int) {
-	if err != nil {
-		fmt.Printf("%s: %v\n", msg, err.Error())
-	} else {
-		fmt.Printf("%s\n", msg)
+// scaffold creates a new site in dir from the starter kit
+// for theme, and returns the names of the files created.
+// Unless force is true dir has to be empty or not exist yet.
+func scaffold(dir string, theme string, siteName string, force bool) (created []string, err error) {
+	root := path.Join("starters", theme)
+	if _, err := fs.Stat(starterFiles, root); err != nil {
+		return nil, fmt.Errorf("no theme named %q. Choose from %s", theme, strings.Join(starterThemes(), ", "))
 	}
-	os.Exit(exitCode)
+	if !force {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			return nil, fmt.Errorf("%s isn't empty. Use -force to create the site anyway", dir)
+		}
+	}
+	data := starterData{SiteName: siteName}
+	err = fs.WalkDir(starterFiles, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+		target := filepath.Join(dir, filepath.FromSlash(rel))
+		if d.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		contents, err := starterFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(target, ".tmpl") {
+			target = strings.TrimSuffix(target, ".tmpl")
+			t, err := texttemplate.New(rel).Delims("[[", "]]").Funcs(starterFuncs).Parse(string(contents))
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			if err := t.Execute(&buf, data); err != nil {
+				return err
+			}
+			contents = buf.Bytes()
+		}
+		if err := writeFileAtomic(target, func(w io.Writer) error {
+			_, err := w.Write(contents)
+			return err
+		}); err != nil {
+			return err
+		}
+		created = append(created, target)
+		return nil
+	})
+	return created, err
 }
 
-// mdDirectoryTreeToHTML takes startDir as the root directory,
-// converts all files (except those in exclude.List) to HTML,
-// and deposits them in www. Attempts to create www if it
-// doesn't exist. www is expected to be a subdirectory of
-// startDir.
-func mdDirectoryTreeToHTML(startDir string, www string, exclude searchInfo, markdownExtensions searchInfo) {
+// WORKER POOL
+// Converting and copying files are independent of each
+// other, so they're handed out to a pool of goroutines.
+
+// buildJob describes a single file in the project tree
+// and where its output goes.
+type buildJob struct {
+	// Source file relative to the project root, using forward
+	// slashes. This is its name in the manifest.
+	key string
+	// Full pathname of the source file
+	source string
+	// Full pathname of the output file and its directory
+	target    string
+	targetDir string
+	// Output file relative to the publish directory
+	output string
+	// true if it's a Markdown file to convert to HTML.
+	// false if it's copied unchanged to the output directory.
+	convert bool
+	// Converted Markdown files are wrapped in this
+	layout *pageLayout
+	// Layout named in the file's front matter, and the
+	// key of the layout it ended up with
+	layoutFile string
+	layoutKey  string
+	// true if the file must be built even if it hasn't changed
+	rebuild bool
+}
+
+// buildAction says what was done with a file.
+type buildAction int
+
+const (
+	actionSkipped buildAction = iota
+	actionConverted
+	actionCopied
+)
+
+// buildResult is what a worker reports back after
+// processing a buildJob.
+type buildResult struct {
+	key    string
+	entry  manifestEntry
+	action buildAction
+	err    *fileError
+}
+
+// runBuildJobs processes jobs using a pool of workers goroutines,
+// checking each one against the previous build's manifest and
+// recording it in manifest. Unless keepGoing is true no more
+// jobs are started after the first error, but the ones in
+// progress are allowed to finish.
+// Returns a report of what happened, including every error.
+func runBuildJobs(jobs []buildJob, workers int, keepGoing bool, previous *buildManifest, manifest *buildManifest) (report *buildReport) {
+	report = &buildReport{}
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan buildJob)
+	results := make(chan buildResult)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				results <- job.build(previous)
+			}
+		}()
+	}
+
+	// Hand out jobs until they're gone or something fails.
+	go func() {
+		defer close(queue)
+		for _, job := range jobs {
+			select {
+			case queue <- job:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// Close results once the last worker is done so
+	// the loop below knows when to stop.
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Only this goroutine touches the manifest and the report.
+	for r := range results {
+		if r.err != nil {
+			if len(report.Errors) == 0 && !keepGoing {
+				close(stop)
+			}
+			report.Errors = append(report.Errors, r.err)
+			continue
+		}
+		manifest.Files[r.key] = r.entry
+		switch r.action {
+		case actionSkipped:
+			report.skipped++
+		case actionConverted:
+			report.converted++
+		case actionCopied:
+			report.copied++
+		}
+	}
+	return report
+}
 
+// build converts or copies the file described by job, unless
+// the previous build's output is still current.
+// Output files are replaced atomically, so if anything goes
+// wrong the previous version is left in place and nothing
+// is written halfway.
+func (job buildJob) build(previous *buildManifest) (result buildResult) {
 	var err error
+	result.key = job.key
 
-	// Change to requested directory
-	if err = os.Chdir(startDir); err != nil {
-		quit(fmt.Sprintf("Unable to change to directory %s", startDir), err, 1)
+	// Skip the file if the last build already produced
+	// its output and the source hasn't changed since.
+	var current bool
+	result.entry, current = previous.current(job.key, job.source, job.target, job.output)
+	result.entry.LayoutFile = job.layoutFile
+	result.entry.Layout = job.layoutKey
+	if current && !job.rebuild {
+		result.action = actionSkipped
+		return result
 	}
 
-  // Cache project's root directory
-	var currDir string
-	if currDir, err = os.Getwd(); err != nil {
-		quit("Unable to get name of current directory", err, 1)
+	if !dirExists(job.targetDir) {
+		if err = os.MkdirAll(job.targetDir, os.ModePerm); err != nil {
+			result.err = &fileError{job.key, stepMkdir, err}
+			return result
+		}
 	}
 
-  // Collect all the files required for this project.
-  // exclude.List contains a list of files not to process.
-	files, err := getProjectTree(".", exclude)
-	if err != nil {
-		quit("Unable to get directory tree", err, 1)
+	if job.convert {
+		// Read the Markdown file, then convert it to an HTML string
+		var markdown, body, article []byte
+		var headings []Heading
+		var HTML string
+		var front map[string]interface{}
+		var settings pageSettings
+		if markdown, err = ioutil.ReadFile(job.source); err != nil {
+			result.err = &fileError{job.key, stepRead, err}
+			return result
+		}
+		if front, body, err = splitFrontMatter(markdown); err == nil {
+			settings, err = newPageSettings(front)
+		}
+		if err != nil {
+			result.err = &fileError{job.key, stepFrontMatter, err}
+			return result
+		}
+		var converter goldmark.Markdown
+		if converter, err = job.layout.markdown(settings); err != nil {
+			result.err = &fileError{job.key, stepFrontMatter, err}
+			return result
+		}
+		if article, headings, err = mdToHTMLHeadings(body, converter); err != nil {
+			result.err = &fileError{job.key, stepConvert, err}
+			return result
+		}
+		// Make it a complete HTML document
+		if HTML, err = job.layout.apply(article, headings, job.key, settings); err != nil {
+			result.err = &fileError{job.key, stepLayout, err}
+			return result
+		}
+		// Write the string to the new filename and location
+		if err = writeStringToFile(job.target, HTML); err != nil {
+			result.err = &fileError{job.key, stepWrite, err}
+			return result
+		}
+		result.action = actionConverted
+	} else {
+		// Not a Markdown file. Copy unchanged.
+		if err = copyFile(job.source, job.target); err != nil {
+			result.err = &fileError{job.key, stepCopy, err}
+			return result
+		}
+		result.action = actionCopied
 	}
+	return result
+}
 
-	// Now have list of all files in directory tree.
-	// If markdown, convert to HTML and copy that file to the HTML publication directory.
-	// If not, copy to target publication directory unchanged.
+// BUILD REPORT
+// A file that can't be built doesn't stop the build. What
+// went wrong is collected here so it can all be shown at the end.
 
-	// Full pathname of file to copy to target directory
-	var source string
+// buildStep names the part of building a file that failed.
+type buildStep string
 
-  // Full pathname of output directory for copied files
-  var target string
+const (
+	stepRead        buildStep = "read"
+	stepFrontMatter buildStep = "front matter"
+	stepConvert     buildStep = "convert"
+	stepLayout      buildStep = "layout"
+	stepOutput      buildStep = "output"
+	stepMkdir       buildStep = "mkdir"
+	stepWrite       buildStep = "write"
+	stepCopy        buildStep = "copy"
+	stepRemove      buildStep = "remove"
+)
 
-  // After Markdown file is converted to HTML, it ends up in this string.
-  // and eventually 
-	var HTML string
+// fileError describes a file that couldn't be built.
+type fileError struct {
+	// Source file relative to the project root. For stepRemove
+	// it's the stale output file, relative to the publish directory.
+	Path string
+	Step buildStep
+	Err  error
+}
 
-  // Relative directory of file. Required to determine where
-  // to copy target file.
-	var rel string
+func (e *fileError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Path, e.Step, e.Err)
+}
 
+func (e *fileError) Unwrap() error {
+	return e.Err
+}
 
-  // true if it was converted to HTML.
-  // false if it's not a Markdown file, which means it will be copied 
-  // unchanged to the output directory
-  var converted bool
+// buildReport is the result of building a directory tree.
+type buildReport struct {
+	buildStats
+	// Errors is sorted by path.
+	Errors []*fileError
+}
 
+// sortErrors puts the errors in order by path. Workers
+// finish in no particular order.
+func (r *buildReport) sortErrors() {
+	sort.SliceStable(r.Errors, func(i, j int) bool {
+		return r.Errors[i].Path < r.Errors[j].Path
+	})
+}
 
-  // Main loop. Traverse the list of files to be copied. 
-  // If a file is Markdown as determined by its file extension,
-  // convert to HTML and copy to output directory.
-  // If a file isn't Markdown, copy to output directory with
-  // no processing.
-	for _, filename := range files {
+// Failed returns true if any file couldn't be built.
+func (r *buildReport) Failed() bool {
+	return len(r.Errors) > 0
+}
 
-    // true if it's  Markdown file converted to HTML
-    converted = false
+// Summary returns the counts followed by one line per error.
+func (r *buildReport) Summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v", r.buildStats)
+	if r.Failed() {
+		fmt.Fprintf(&b, ", %d failed", len(r.Errors))
+	}
+	for _, e := range r.Errors {
+		fmt.Fprintf(&b, "\n\t%v", e)
+	}
+	return b.String()
+}
 
-    // Get the fully qualified pathname for this file.
-		filename = filepath.Join(currDir, filename)
+// BUILD MANIFEST
+// The manifest lets a build skip any file whose
+// output from the previous build is still current.
 
-    // Separate out the file's origin directory
-		sourceDir := filepath.Dir(filename)
-		//fmt.Printf("%s\n", filename)
+// manifestFilename is the name of the manifest file. It
+// lives in the root of the publish directory.
+const manifestFilename = ".microcms-manifest.json"
 
-    // Get the relatve directory. For example, if your directory
-    // is ~/raj/blog and you're in ~/raj/blog/2023/may, then
-    // the relative directory is 2023/may.
-		if rel, err = filepath.Rel(currDir, sourceDir); err != nil {
-			quit(fmt.Sprintf("Unable to get relative paths of %s and %s\n", filename, www), err, 1)
-		}
+// manifestEntry records what a source file looked like
+// when its output was last generated.
+type manifestEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// SHA-256 of the file contents, in hex
+	Hash string `json:"hash"`
+	// Generated or copied file, relative to the publish directory.
+	// Empty for drafts.
+	Output string `json:"output"`
+	// Set from front matter. Drafts have no output.
+	Draft      bool   `json:"draft,omitempty"`
+	LayoutFile string `json:"layoutFile,omitempty"`
+	// Key of the layout a Markdown file was built with
+	Layout string `json:"layout,omitempty"`
+}
 
-    // Determine the destination directory. If the base publish
-    // directory is named WWW, then in the previous example
-    // it would be ~/raj/blog/WWW, or ~/raj/blog/WWW/2023/may
-		targetDir := filepath.Join(currDir, www, rel)
-		// Obtain file extension.
-		ext := path.Ext(filename)
-		// Replace converted filename extension, from markdown to HTML.
-		// Only convert to HTML if it has a Markdown extension.
-		if markdownExtensions.Found(ext) {
-			// Convert the Markdown file to an HTML string
-			if HTML, err = mdFileToHTML(filename); err != nil {
-				quit("Error converting Markdown file to HTML", err, 1)
-			}
-			// Strip origal file's Markdown extension and make 
-      // the destination files' extension HTML
-			source = filename[0:len(filename)-len(ext)] + ".html"
-			target = filepath.Join(targetDir, filepath.Base(source))
-      // Write the string to the new filename and location
-			//writeStringToFile(target, HTML)
-      converted = true
-		} else {
-			// Not a Markdown file. Copy unchanged.
-			// Insert destination (WWW) directory
-			//target = filepath.Join(filename, www)
+// buildManifest maps the path of each source file, relative
+// to the project root and using forward slashes, to its entry.
+type buildManifest struct {
+	Files map[string]manifestEntry `json:"files"`
+}
+
+// buildStats counts what a build did with each file.
+type buildStats struct {
+	converted int
+	copied    int
+	skipped   int
+	removed   int
+}
+
+func (s buildStats) String() string {
+	return fmt.Sprintf("%d converted, %d copied, %d skipped, %d removed",
+		s.converted, s.copied, s.skipped, s.removed)
+}
+
+func newManifest() *buildManifest {
+	return &buildManifest{Files: make(map[string]manifestEntry)}
+}
+
+// readManifest returns the manifest from the publish directory www.
+// A missing or unreadable manifest just means everything gets
+// rebuilt, so it returns an empty manifest in that case.
+func readManifest(www string) *buildManifest {
+	m := newManifest()
+	b, err := ioutil.ReadFile(filepath.Join(www, manifestFilename))
+	if err != nil {
+		return m
+	}
+	if err = json.Unmarshal(b, m); err != nil || m.Files == nil {
+		return newManifest()
+	}
+	return m
+}
+
+// write saves the manifest to the publish directory www.
+func (m *buildManifest) write(www string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	// A build that's interrupted mustn't leave half a manifest,
+	// which would make the next build misjudge what changed.
+	return writeFileAtomic(filepath.Join(www, manifestFilename), func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// current compares the source file filename, known in the manifest
+// as key, against what the previous build recorded for it.
+// target is the full pathname of the output file and output is
+// its name relative to the publish directory.
+// It returns an up-to-date entry for the file, and true if
+// target doesn't need to be generated again.
+// Size and modification time are checked first because they're
+// cheap. If either has changed the contents are hashed, so touching
+// a file or checking it out again doesn't force a rebuild.
+func (m *buildManifest) current(key, filename, target, output string) (manifestEntry, bool) {
+	var entry manifestEntry
+	info, err := os.Stat(filename)
+	if err != nil {
+		return entry, false
+	}
+	entry.Size = info.Size()
+	entry.ModTime = info.ModTime()
+	entry.Output = output
+
+	prev, found := m.Files[key]
+	// Something has to be written if this file is new,
+	// would end up somewhere else, or the output has
+	// been deleted since the last build.
+	outputExists := fileExists(target)
+	if found && prev.Output == output && outputExists &&
+		prev.Size == entry.Size && prev.ModTime.Equal(entry.ModTime) {
+		entry.Hash = prev.Hash
+		return entry, true
+	}
+	if entry.Hash, err = fileHash(filename); err != nil {
+		return entry, false
+	}
+	return entry, found && prev.Output == output && outputExists && prev.Hash == entry.Hash
+}
 
-			source = filename
-			target = filepath.Join(targetDir, filepath.Base(source))
-			fmt.Printf("NOT Markdown: Copy %s to %s\n", filename, target)
-      converted = false
+// removeStale deletes every output file recorded in this manifest,
+// the previous build's, that isn't also recorded in current, along
+// with any directories that leaves empty.
+// Returns the number of files removed and any that couldn't be.
+func (m *buildManifest) removeStale(current *buildManifest, www string) (removed int, errs []*fileError) {
+	inUse := make(map[string]bool)
+	for _, entry := range current.Files {
+		inUse[entry.Output] = true
+	}
+	for _, prev := range m.Files {
+		if prev.Output == "" || inUse[prev.Output] {
+			continue
 		}
-		if sourceDir != currDir && !dirExists(targetDir) {
-			//fmt.Printf("mkdir %s\n", targetDir)
-			err := os.MkdirAll(targetDir, os.ModePerm)
-			if err != nil && !os.IsExist(err) {
-				quit(fmt.Sprintf("Unable to create directory %s", targetDir), err, 1)
+		// Two old entries can share an output. Only remove it once.
+		inUse[prev.Output] = true
+		target := filepath.Join(www, filepath.FromSlash(prev.Output))
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, &fileError{prev.Output, stepRemove, err})
+			continue
+		}
+		removed++
+		// Clean up directories emptied by the removal. os.Remove()
+		// fails harmlessly on a directory that still has files in it.
+		for dir := filepath.Dir(target); dir != www && strings.HasPrefix(dir, www); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
 			}
 		}
-		// xxx
-    if converted { 
-      writeStringToFile(target, HTML)
-    } else {
-		  //fmt.Printf("copy %s to %s\n", source, target)
-		  copyFile(source, target)
-    }
 	}
+	return removed, errs
+}
+
+// keep copies into current the entry from this manifest for every
+// file in inTree that current doesn't have. It's used for files
+// that failed or were never reached, so the next build still
+// knows about their output.
+func (m *buildManifest) keep(current *buildManifest, inTree map[string]bool) {
+	for key := range inTree {
+		if _, ok := current.Files[key]; ok {
+			continue
+		}
+		if prev, ok := m.Files[key]; ok {
+			current.Files[key] = prev
+		}
+	}
+}
+
+// fileHash returns the SHA-256 hash of the named file's contents in hex.
+func fileHash(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // FILE UTILITIES
-// Clear but
-func copyFile(source string, target string) {
+// copyFile copies source to target, replacing target
+// atomically if it already exists.
+func copyFile(source string, target string) error {
 	if source == target {
-		quit(fmt.Sprintf("copyFile: %s and %s are the same", source, target), nil, 1)
+		return fmt.Errorf("copyFile: %s and %s are the same", source, target)
 	}
 	if source == "" {
-		quit("copyFile: no source file specified", nil, 1)
+		return fmt.Errorf("copyFile: no source file specified")
 	}
 	if target == "" {
-		quit(fmt.Sprintf("copyFile: no destination file specified for file %s", source), nil, 1)
+		return fmt.Errorf("copyFile: no destination file specified for file %s", source)
 	}
-	if src, err := os.Open(source); err != nil {
-		quit(fmt.Sprintf("copyFile: Unable to open file %s", source), err, 1)
-	} else {
-		if trgt, err := os.Create(target); err != nil {
-			quit(fmt.Sprintf("copyFile: Unable to create file %s", target), err, 1)
-		} else {
-			if _, err := io.Copy(src, trgt); err != nil {
-				quit(fmt.Sprintf("Error copying file %s to %s", source, target), err, 1)
-			}
+	src, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("copyFile: Unable to open file %s: %w", source, err)
+	}
+	defer src.Close()
+	return writeFileAtomic(target, func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+// writeFileAtomic creates filename by passing a temporary
+// file in the same directory to write, then renaming it to
+// filename. Readers see either the old file or the
+// complete new one, never part of it. If write fails the
+// temporary file is removed and filename is untouched.
+func writeFileAtomic(filename string, write func(w io.Writer) error) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create file %s: %w", filename, err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
 		}
+	}()
+	if err = write(tmp); err != nil {
+		return fmt.Errorf("error writing to file %s: %w", filename, err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("error writing to file %s: %w", filename, err)
+	}
+	// TempFile() creates files readable only by their owner,
+	// which isn't what anyone wants in a web directory.
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
 	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// fileExists() returns true, well, if the named file exists
+func fileExists(filename string) bool {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return false
+	}
+	return err == nil && !info.IsDir()
 }
 
 // dirExists() returns true if the name passed to it is a directory.
@@ -288,18 +3323,12 @@ func dirExists(path string) bool {
 }
 
 // writeStringToFile creates a file called filename without checking to see if it
-// exists, then writes contents to it.
-func writeStringToFile(filename, contents string) {
-	fmt.Printf("writeStringToFile filename: %s\n", filename)
-	var out *os.File
-	var err error
-	if out, err = os.Create(filename); err != nil {
-		quit(fmt.Sprintf("writeStringToFile: Unable to create file %s", filename), err, 1)
-	}
-	if _, err = out.WriteString(contents); err != nil {
-		// TODO: Renumber error code?
-		quit(fmt.Sprintf("Error writing to file %s", filename), err, 1)
-	}
+// exists, then writes contents to it. An existing file is replaced atomically.
+func writeStringToFile(filename, contents string) error {
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		_, err := io.WriteString(w, contents)
+		return err
+	})
 }
 
 // SLICE UTILITIES
@@ -334,10 +3363,7 @@ func (s *searchInfo) Found(searchFor string) bool {
 
 // DIRECTORY TREE
 
-func visit(files *[]string, exclude searchInfo) filepath.WalkFunc {
-	// var exclude searchInfo
-	// Find out what directories to exclude
-	//exclude.list = []string{"node_modules", "main.bak", ".git", "pub", ".DS_Store", ".gitignore"}
+func visit(files *[]string, ignore *ignoreRules) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			// Quietly fail if unable to access path.
@@ -345,16 +3371,13 @@ func visit(files *[]string, exclude searchInfo) filepath.WalkFunc {
 		}
 		isDir := info.IsDir()
 
-		// Obtain just the filename.
-		name := filepath.Base(info.Name())
-
-		// Skip any directory to be excluded, such as
+		// Skip any directory to be ignored, such as
 		// the pub and .git directores
-		if exclude.Found(name) && isDir {
+		if ignore.Ignored(path, isDir) && isDir {
 			return filepath.SkipDir
 		}
-		// It may be just a filename on the exclude list.
-		if exclude.Found(name) {
+		// It may be just a file to be ignored.
+		if ignore.Ignored(path, isDir) {
 			return nil
 		}
 
@@ -370,11 +3393,181 @@ func visit(files *[]string, exclude searchInfo) filepath.WalkFunc {
 // at the root.
 // Ignore directories starting with a .
 // Ignore the assets directory
-func getProjectTree(path string, exclude searchInfo) (tree []string, err error) {
+func getProjectTree(path string, ignore *ignoreRules) (tree []string, err error) {
 	var files []string
-	err = filepath.Walk(path, visit(&files, exclude))
+	err = filepath.Walk(path, visit(&files, ignore))
 	if err != nil {
 		return []string{}, err
 	}
 	return files, nil
 }
+
+// IGNORE RULES
+// Files to leave out of the site use the same patterns as
+// .gitignore. The directory tree and the watcher both use
+// these rules, so the watcher never sees an ignored file.
+//
+// Each line of the ignore file is a pattern:
+//   - Blank lines and lines starting with # do nothing.
+//   - * matches anything but a slash, ? matches any one
+//     character but a slash, and [a-z] matches a range.
+//   - A pattern with no slash, like *.bak, matches
+//     files with that name in any directory.
+//   - A pattern with a slash, like /notes or docs/*.txt,
+//     matches paths relative to the project directory.
+//   - ** matches any number of directories, as in docs/**/*.txt.
+//   - A pattern ending in a slash only matches directories.
+//   - A pattern starting with ! includes files an earlier
+//     pattern left out. Files inside an ignored directory
+//     can't be included this way, just as with git.
+//   - A backslash before a leading # or ! makes it literal.
+// Later patterns take precedence over earlier ones.
+
+// ignoreRule is a single pattern from an ignore file.
+type ignoreRule struct {
+	// Without any !, leading slash, or trailing slash
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreRules decides which files aren't part of the site.
+type ignoreRules struct {
+	rules []ignoreRule
+}
+
+// newIgnoreRules returns rules made from patterns in
+// the format of an ignore file line.
+func newIgnoreRules(patterns []string) *ignoreRules {
+	r := &ignoreRules{}
+	for _, pattern := range patterns {
+		r.add(pattern)
+	}
+	return r
+}
+
+// readIgnoreFile returns the rules in defaults followed by
+// those in filename. It's fine if filename doesn't exist.
+func readIgnoreFile(filename string, defaults []string) (*ignoreRules, error) {
+	r := newIgnoreRules(defaults)
+	b, err := ioutil.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		r.add(line)
+	}
+	return r, nil
+}
+
+// add appends a pattern. Blank lines and comments are skipped.
+func (r *ignoreRules) add(pattern string) {
+	pattern = strings.TrimRight(pattern, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return
+	}
+	var rule ignoreRule
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\#`) || strings.HasPrefix(pattern, `\!`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	rule.anchored = strings.Contains(pattern, "/")
+	rule.pattern = strings.TrimPrefix(pattern, "/")
+	if rule.pattern == "" {
+		return
+	}
+	r.rules = append(r.rules, rule)
+}
+
+// withOutput returns a copy of the rules that also ignores
+// the publish directory www, whatever the other rules say.
+func (r *ignoreRules) withOutput(www string) *ignoreRules {
+	c := &ignoreRules{rules: append([]ignoreRule{}, r.rules...)}
+	c.add("/" + filepath.ToSlash(filepath.Clean(www)) + "/")
+	return c
+}
+
+// Ignored returns true if the file or directory at rel, a path
+// relative to the project directory, isn't part of the site.
+func (r *ignoreRules) Ignored(rel string, isDir bool) bool {
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	if rel == "." {
+		return false
+	}
+	// Nothing inside an ignored directory is part of the site.
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if r.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return r.match(rel, isDir)
+}
+
+// IgnoredPath is like Ignored for a full path to a file
+// in the project directory root. Anything outside root,
+// like a template file, isn't ignored.
+func (r *ignoreRules) IgnoredPath(root, filename string, isDir bool) bool {
+	rel, err := filepath.Rel(root, filename)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	return r.Ignored(rel, isDir)
+}
+
+// match applies the rules to rel alone, ignoring its parents.
+// The last rule that matches decides.
+func (r *ignoreRules) match(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range r.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.matches(rel) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matches returns true if the rule's pattern matches rel.
+func (rule ignoreRule) matches(rel string) bool {
+	if !rule.anchored {
+		ok, _ := path.Match(rule.pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(rule.pattern, "/"), strings.Split(rel, "/"))
+}
+
+// matchSegments matches a pattern against a path one
+// directory at a time, so ** can stand for any number of them.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
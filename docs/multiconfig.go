@@ -8,6 +8,11 @@
   [windows.Features]
     home = "C:\Users\Userdata\t\code"
 
+Adding a section edits the file in place, so comments and
+everything else in it are kept. That's done by tomledit.go,
+so build it along with this file:
+
+  go run multiconfig.go tomledit.go
 */
 package main
 
@@ -38,22 +43,6 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
-// writeMapFile() creates a TOML file based on the filename and
-// map passed in.
-func writeMapFile(filename string, target interface{}) error {
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	if err = toml.NewEncoder(f).Encode(target); err != nil {
-		return err
-	}
-	if err := f.Close(); err != nil {
-		return err
-	}
-	return nil
-}
-
 func readMapFile(filename string) (c map[string]Config, err error) {
 	var input []byte
 	var cfg map[string]Config
@@ -73,55 +62,39 @@ type Config struct {
 }
 
 func main() {
-	var cfg map[string]Config
-	var c Config
 	// Get operating system identifier as a string
 	OS := runtime.GOOS
 	// Can test creating new entries by uncommenting this
 	// and assigning it different values
 	//OS = "foo"
 
-	// No config file at all, so create one.
 	if !fileExists(configFilename) {
 		fmt.Println("Creating", configFilename)
-		// Create the global config.
-		cfg = make(map[string]Config)
-		// This is the "subfile", which doesn't know what OS it's for.
-		c.Features = make(map[string]string)
-		// Note current directory
-		c.Features["home"] = currDir()
-		// Add an entry in the file for the current OS.
-		cfg[OS] = c
-		// Create the file using current config info.
-		if err := writeMapFile(configFilename, &cfg); err != nil {
-			panic(err.Error())
-		}
-		fmt.Println("Created", configFilename)
-		os.Exit(0)
-	}
-	// Config file exists. Don't know if it has an
-	// entry for this OS.
-	var err error
-	// Read the existing file.
-	if cfg, err = readMapFile(configFilename); err != nil {
-		panic(err.Error())
 	}
-	_, ok := cfg[OS]
-	// Is there an entry for this OS?
-	if !ok {
-		// No. Create one.
-		var f Config
-		// Have to allocate the submap.
-		f.Features = make(map[string]string)
-		f.Features["home"] = currDir()
-		// Then allocate the new one by assigning the old one.
-		cfg[OS] = f
-		// And save as a file.
-		if err := writeMapFile(configFilename, &cfg); err != nil {
-			panic(err.Error())
+	// Add an entry in the file for the current OS unless
+	// there already is one. Entries for other operating
+	// systems, and any comments, are left alone.
+	table := OS + ".Features"
+	added := false
+	err := editTOMLFile(configFilename, func(doc *tomlDocument) error {
+		if doc.HasTable(table) {
+			return nil
 		}
-		os.Exit(0)
-	} else {
+		added = true
+		// Note current directory
+		return doc.Set(table, "home", currDir())
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if !added {
 		fmt.Println("Already have an entry for", OS)
 	}
+	cfg, err := readMapFile(configFilename)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("home on %s: %s\n", OS, cfg[OS].Features["home"])
 }
@@ -0,0 +1,381 @@
+package main
+
+/* A working version of shortcodefail.go.
+ *
+ * Shortcodes let you insert HTML that Markdown can't express,
+ * like a YouTube player, into a page. A shortcode is a small
+ * Go template that is called from a page like this:
+ *
+ *   {{shortcode "youtube" "id" "tcrTQUVkUe0"}}
+ *
+ * After the shortcode's name come any number of name/value pairs.
+ * The shortcode sees them as .Params, along with the site and
+ * page data as .Site and .Page, so youtube looks like this:
+ *
+ *   <iframe src="https://www.youtube.com/embed/{{.Params.id}}"
+ *   allowfullscreen></iframe>
+ *
+ * Template variables can be passed as values:
+ *
+ *   {{$v:="tcrTQUVkUe0"}}
+ *   {{shortcode "youtube" "id" $v}}
+ *
+ * shortcodefail.go couldn't do two things. First, the shortcode
+ * couldn't see $v, because a template variable belongs to the
+ * template that declared it. Passing it as a parameter fixes that.
+ * Second, the shortcode function couldn't be in the FuncMap it used
+ * itself, because a package-level FuncMap naming shortcode(), whose
+ * body refers back to that FuncMap, is an initialization cycle. Here
+ * the FuncMap is built at runtime by a shortcodeRenderer, so a
+ * shortcode can call other shortcodes.
+ *
+ * A shortcode calling another can go wrong in two ways: it can
+ * call itself, directly or through others, or the chain of calls
+ * can just get too long. The renderer keeps a stack of the shortcodes
+ * being run, and reports an error, for example
+ *
+ *   shortcode recursion: loop -> again -> loop
+ *
+ * instead of letting the stack overflow.
+ *
+ * Shortcodes live in files. Each name.html file in the
+ * shortcodes directory can be called as {{shortcode "name"}}.
+ * A few built-in shortcodes, in defaults/shortcodes, are embedded
+ * in the executable, so they're always available. A file in
+ * shortcodes with the same name as a built-in one replaces it.
+ */
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"html/template"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Built-in shortcodes. A populated subdirectory
+// named defaults/shortcodes is required.
+//
+//go:embed defaults/shortcodes
+var defaultShortcodes embed.FS
+
+const (
+	// Shortcodes may call other shortcodes this deep
+	defaultMaxShortcodeDepth = 10
+
+	// Where the built-in shortcodes are in defaultShortcodes
+	defaultShortcodeDir = "defaults/shortcodes"
+
+	// A project's own shortcodes are in this directory
+	shortcodeDir = "shortcodes"
+
+	// Only files with this extension are shortcodes
+	shortcodeExtension = ".html"
+)
+
+type SiteConfigs struct {
+	Name string
+}
+
+type PageConfigs struct {
+	Title string
+}
+
+// Data is what a page's template sees.
+type Data struct {
+	Site *SiteConfigs
+	Page *PageConfigs
+}
+
+// ShortcodeData is what a shortcode's template sees. It
+// has everything the page sees, plus its parameters.
+type ShortcodeData struct {
+	Site   *SiteConfigs
+	Page   *PageConfigs
+	Params map[string]interface{}
+}
+
+// shortcodeLibrary holds the source of every known shortcode.
+type shortcodeLibrary struct {
+	// Template source by shortcode name
+	sources map[string]string
+
+	// Where each shortcode came from, by name
+	origins map[string]string
+
+	// How many shortcodes can be running at once
+	// before it's considered an error. Shortcodes
+	// called directly from a page are at depth 1.
+	maxDepth int
+}
+
+// newShortcodeLibrary returns an empty library.
+func newShortcodeLibrary() *shortcodeLibrary {
+	return &shortcodeLibrary{
+		sources:  make(map[string]string),
+		origins:  make(map[string]string),
+		maxDepth: defaultMaxShortcodeDepth,
+	}
+}
+
+// loadShortcodes returns a library containing the built-in
+// shortcodes, plus those in the shortcodes directory under
+// projectDir. It's fine if that directory doesn't exist.
+func loadShortcodes(projectDir string) (*shortcodeLibrary, error) {
+	lib := newShortcodeLibrary()
+	if err := lib.addDir(defaultShortcodes, defaultShortcodeDir, "built-in"); err != nil {
+		return nil, err
+	}
+	err := lib.addDir(os.DirFS(projectDir), shortcodeDir, "")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return lib, nil
+}
+
+// addDir makes every name.html file in dir callable as the
+// shortcode name, replacing any shortcode already by that name.
+// origin describes where the files came from. If it's empty,
+// the directory name is used.
+func (lib *shortcodeLibrary) addDir(fsys fs.FS, dir string, origin string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != shortcodeExtension {
+			continue
+		}
+		filename := path.Join(dir, entry.Name())
+		source, err := fs.ReadFile(fsys, filename)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(entry.Name(), shortcodeExtension)
+		lib.add(name, string(source))
+		if origin != "" {
+			lib.origins[name] = origin
+		} else {
+			lib.origins[name] = filename
+		}
+	}
+	return nil
+}
+
+// add makes source callable as the shortcode name.
+func (lib *shortcodeLibrary) add(name, source string) {
+	lib.sources[name] = source
+	lib.origins[name] = "added at runtime"
+}
+
+// names returns the name of every shortcode, sorted.
+func (lib *shortcodeLibrary) names() []string {
+	names := make([]string, 0, len(lib.sources))
+	for name := range lib.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// shortcodeRenderer runs shortcodes for a single page. It
+// isn't safe for concurrent use, so use one per page.
+type shortcodeRenderer struct {
+	lib  *shortcodeLibrary
+	data Data
+	// Names of the shortcodes now running, outermost first
+	stack []string
+}
+
+// shortcodeError is a problem running a shortcode. Errors from
+// nested shortcodes are passed up unchanged, instead of being
+// wrapped by each template on the way out.
+type shortcodeError struct {
+	msg string
+}
+
+func (e *shortcodeError) Error() string {
+	return e.msg
+}
+
+// newRenderer returns a renderer for a page with the given data.
+func (lib *shortcodeLibrary) newRenderer(data Data) *shortcodeRenderer {
+	return &shortcodeRenderer{lib: lib, data: data}
+}
+
+// funcs returns the custom functions available to pages
+// and shortcodes. Because it's built at runtime shortcode()
+// can be included, with no initialization cycle.
+func (r *shortcodeRenderer) funcs() template.FuncMap {
+	return template.FuncMap{"now": now, "shortcode": r.shortcode}
+}
+
+// shortcode is the shortcode template function. It runs the
+// shortcode name, whose parameters are given by args as
+// name/value pairs, and returns the resulting HTML.
+func (r *shortcodeRenderer) shortcode(name string, args ...interface{}) (template.HTML, error) {
+	source, ok := r.lib.sources[name]
+	if !ok {
+		return "", &shortcodeError{fmt.Sprintf("unknown shortcode %q", name)}
+	}
+	for _, running := range r.stack {
+		if running == name {
+			chain := append(append([]string{}, r.stack...), name)
+			return "", &shortcodeError{"shortcode recursion: " + strings.Join(chain, " -> ")}
+		}
+	}
+	if len(r.stack) >= r.lib.maxDepth {
+		chain := append(append([]string{}, r.stack...), name)
+		return "", &shortcodeError{fmt.Sprintf("shortcode %q is nested more than %d deep: %s",
+			name, r.lib.maxDepth, strings.Join(chain, " -> "))}
+	}
+	params, err := shortcodeParams(name, args)
+	if err != nil {
+		return "", err
+	}
+
+	r.stack = append(r.stack, name)
+	defer func() { r.stack = r.stack[:len(r.stack)-1] }()
+
+	shortcodeData := ShortcodeData{
+		Site:   r.data.Site,
+		Page:   r.data.Page,
+		Params: params,
+	}
+	s, err := r.execute("shortcode "+name, source, shortcodeData)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(s), nil
+}
+
+// shortcodeParams turns the name/value pairs passed
+// to a shortcode into a map.
+func shortcodeParams(name string, args []interface{}) (map[string]interface{}, error) {
+	if len(args)%2 != 0 {
+		return nil, &shortcodeError{fmt.Sprintf("shortcode %q: parameter %v has no value", name, args[len(args)-1])}
+	}
+	params := make(map[string]interface{}, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		key, ok := args[i].(string)
+		if !ok {
+			return nil, &shortcodeError{fmt.Sprintf("shortcode %q: parameter name %v isn't a string", name, args[i])}
+		}
+		params[key] = args[i+1]
+	}
+	return params, nil
+}
+
+// render executes a page's template source, including
+// any shortcodes it calls, and returns the result.
+func (r *shortcodeRenderer) render(templateName string, source string) (string, error) {
+	return r.execute(templateName, source, r.data)
+}
+
+// Parse a template, then execute it against HTML/template source.
+// Return a string containing the result. If a shortcode
+// failed, return its error rather than the template's, which
+// would repeat the template name once for every level of nesting.
+func (r *shortcodeRenderer) execute(templateName string, source string, data interface{}) (string, error) {
+	t, err := template.New(templateName).Funcs(r.funcs()).Parse(source)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		var scErr *shortcodeError
+		if errors.As(err, &scErr) {
+			return "", scErr
+		}
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Demo simply to prove that custom functions work
+// in templates.
+func now() string {
+	//Mon Jan 2 15:04
+	return fmt.Sprintf("%v", time.Now().Format("Jan 2, 2006 3:04pm"))
+}
+
+// Display any error message and exit to OS.
+func quit(err error, code int) {
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "Error: %v\n", err.Error())
+	}
+	fmt.Fprintf(os.Stdout, "Quitting with error code %v\n", code)
+	os.Exit(code)
+}
+
+var (
+	// This is the TOML file.
+	config = `name="foo"`
+
+	// Shortcodes that call each other forever
+	loopHTML  = `{{shortcode "again"}}`
+	againHTML = `{{shortcode "loop"}}`
+
+	// A page using the youtube shortcode with a
+	// template variable, and the nested figure shortcode.
+	tpl = `
+	{{$v:="tcrTQUVkUe0" }}Video ID is: {{$v}}.
+	Time is: {{now}}. Site Name is: {{.Site.Name}}
+	{{shortcode "youtube" "id" $v}}
+	{{shortcode "figure" "src" "cat.jpg" "caption" "A cat"}}
+	`
+	// A page that never finishes
+	tpl2 = `{{shortcode "loop"}}`
+)
+
+func main() {
+	// Read the TOML site configuration file. It has only
+	// a single demo, which is the name of the site.
+	var siteConfig SiteConfigs
+	if _, err := toml.Decode(config, &siteConfig); err != nil {
+		quit(err, 1)
+	}
+	data := Data{
+		Site: &siteConfig,
+		Page: &PageConfigs{Title: "Shortcodes"},
+	}
+
+	// Built-in shortcodes, and any in the shortcodes
+	// directory. Try copying defaults/shortcodes/caption.html
+	// to shortcodes/caption.html and changing it.
+	lib, err := loadShortcodes(".")
+	if err != nil {
+		quit(err, 1)
+	}
+	lib.add("loop", loopHTML)
+	lib.add("again", againHTML)
+
+	for _, name := range lib.names() {
+		fmt.Printf("%s (%s)\n", name, lib.origins[name])
+	}
+
+	// Shortcodes with parameters, one calling another.
+	if s, err := lib.newRenderer(data).render("tpl", tpl); err != nil {
+		quit(err, 4)
+	} else {
+		fmt.Println(s)
+	}
+
+	// Recursion is caught and reported.
+	if _, err := lib.newRenderer(data).render("tpl2", tpl2); err != nil {
+		fmt.Println(err)
+	}
+
+	// So is nesting deeper than allowed.
+	lib.maxDepth = 1
+	if _, err := lib.newRenderer(data).render("tpl", tpl); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -55,6 +55,9 @@ package main
  * The output on this one is simply:
  *
  *      test:4: undefined variable "$v"
+ *
+ * See shortcode.go for a version that works, with
+ * parameters and shortcodes that call other shortcodes.
  */
 
 /* Contents of youtube.html:
@@ -0,0 +1,166 @@
+// subcommands.go parses a command line made up of subcommands,
+// each with its own flags, such as
+//
+//	foo -verbose build -output-dir=public news.md
+//
+// The program using it defines globalFlags, the flags allowed
+// anywhere on the command line, and commands, every command by
+// name. This file adds a help command, and lets each command's
+// flags be mixed in with its other arguments in any order.
+//
+// There's no main function here. Build this file along with a
+// program that uses it, such as cmdline.go or microcmsnoyaml.go:
+//
+//	go run cmdline.go subcommands.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command is a subcommand such as init or build.
+type command struct {
+	// What follows the command name in its usage line
+	args string
+	// One-line description
+	summary string
+	flags   *flag.FlagSet
+	// Runs the command, with filenames and other
+	// positional arguments in args.
+	run func(args []string) error
+}
+
+func init() {
+	commands["help"] = &command{
+		args:    "[command]",
+		summary: "Describe a command",
+		flags:   flag.NewFlagSet("help", flag.ContinueOnError),
+		run: func(args []string) error {
+			if len(args) == 0 {
+				usage(os.Stdout)
+				return nil
+			}
+			cmd, ok := commands[args[0]]
+			if !ok {
+				return fmt.Errorf("unknown command %q", args[0])
+			}
+			commandUsage(os.Stdout, args[0], cmd)
+			return nil
+		},
+	}
+	globalFlags.Usage = func() { usage(os.Stderr) }
+	for name, cmd := range commands {
+		name, cmd := name, cmd
+		// Global flags work after the command too, because each
+		// command's flag set shares their values.
+		globalFlags.VisitAll(func(f *flag.Flag) {
+			cmd.flags.Var(f.Value, f.Name, f.Usage)
+		})
+		cmd.flags.Usage = func() { commandUsage(os.Stderr, name, cmd) }
+	}
+}
+
+// usage lists the commands and global flags.
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [global flags] command [flags] [arguments]\n\nCommands:\n", globalFlags.Name())
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-8s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(w, "\nGlobal flags:\n")
+	globalFlags.SetOutput(w)
+	globalFlags.PrintDefaults()
+	fmt.Fprintf(w, "\nRun \"%s help command\" for more about a command.\n", globalFlags.Name())
+}
+
+// commandUsage describes a single command and its flags.
+func commandUsage(w io.Writer, name string, cmd *command) {
+	fmt.Fprintf(w, "Usage: %s %s %s\n\n%s\n", globalFlags.Name(), name, cmd.args, cmd.summary)
+	// Only list the command's own flags here.
+	var own []*flag.Flag
+	cmd.flags.VisitAll(func(f *flag.Flag) {
+		if globalFlags.Lookup(f.Name) == nil {
+			own = append(own, f)
+		}
+	})
+	if len(own) > 0 {
+		fmt.Fprintf(w, "\nFlags:\n")
+		for _, f := range own {
+			fmt.Fprintf(w, "  -%s\n    \t%s", f.Name, f.Usage)
+			if f.DefValue != "" && f.DefValue != "false" {
+				fmt.Fprintf(w, " (default %q)", f.DefValue)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	fmt.Fprintf(w, "\nGlobal flags:\n")
+	globalFlags.SetOutput(w)
+	globalFlags.PrintDefaults()
+}
+
+// parseArgs parses flags from args using fs, allowing flags
+// and other arguments to be mixed in any order. The flag
+// package stops at the first argument that isn't a flag, so
+// this keeps going after it. Anything after -- is never
+// treated as a flag. Returns the arguments that aren't flags.
+func parseArgs(fs *flag.FlagSet, args []string) (positional []string, err error) {
+	if err := checkFlagValues(fs, args); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return nil, err
+	}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		// Parse consumes a -- that ends the flags, so
+		// look at what came just before rest.
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// checkFlagValues returns an error if a flag in args that needs
+// a value, such as -output-dir, is followed by --. The flag
+// package would take -- as the value, instead of as the end
+// of the flags.
+func checkFlagValues(fs *flag.FlagSet, args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return nil
+		}
+		if len(arg) < 2 || arg[0] != '-' || strings.Contains(arg, "=") {
+			continue
+		}
+		f := fs.Lookup(strings.TrimLeft(arg, "-"))
+		if f == nil {
+			continue
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			continue
+		}
+		if i+1 < len(args) && args[i+1] == "--" {
+			return fmt.Errorf("flag needs an argument: %s", arg)
+		}
+		// Skip the flag's value.
+		i++
+	}
+	return nil
+}
@@ -3,36 +3,267 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/user"
-	"path/filepath"
+	"path"
 	"runtime"
+	"strings"
 )
 
-// suggestCfgDir() takes a stab at returning the recommended location
-// of the directory that stores user configuration data. It does
-// so by sniffing the operating system. It returns the suggested
-// directory in the dir variable and the OS it detected in the os variable.
+// Where an application keeps its files depends on the operating
+// system, and on the kind of file. appDirs works out where each
+// kind of file goes:
+//
+//   - Linux and other Unix systems follow the XDG Base Directory
+//     specification. $XDG_CONFIG_HOME, $XDG_CACHE_HOME, $XDG_DATA_HOME
+//     and $XDG_STATE_HOME are used if they're set to an absolute path,
+//     and otherwise ~/.config, ~/.cache, ~/.local/share and
+//     ~/.local/state.
+//   - macOS keeps config in ~/Library/Application Support, with data
+//     and state in their own directories under it, and the cache in
+//     ~/Library/Caches.
+//   - Windows keeps config in %APPDATA%, which roams with the user,
+//     and the rest in %LOCALAPPDATA%, which stays on the machine.
+//   - Plan 9 keeps everything under $home/lib.
+//
+// Each directory gets a subdirectory named after the application.
+// Nothing is created until Create is called.
+//
+// The operating system and environment are fields rather than
+// coming straight from runtime.GOOS and os.Getenv, so the rules for
+// every system can be tried out on any of them. main() does that.
+//
 // Go Playground:
 // https://play.golang.org/p/BeXM5iS66X3
 // Gist:
 // https://gist.github.com/tomcam/508f7a95a269b0d39781590ad47e6e75
-func suggestCfgDir() (dir, system string) {
-	system = runtime.GOOS
-	// Try to determine where user application home dir would be
-	switch system {
+
+// dirKind is a kind of file an application keeps.
+type dirKind int
+
+const (
+	// Settings the user may edit
+	configDir dirKind = iota
+	// Files that can be deleted and made again
+	cacheDir
+	// Files the application creates that should be kept
+	dataDir
+	// Files that should survive a restart, but aren't
+	// important enough to back up, like history or logs
+	stateDir
+)
+
+func (k dirKind) String() string {
+	switch k {
+	case configDir:
+		return "config"
+	case cacheDir:
+		return "cache"
+	case dataDir:
+		return "data"
+	case stateDir:
+		return "state"
+	}
+	return fmt.Sprintf("dirKind(%d)", int(k))
+}
+
+// appDirs finds the directories an application keeps its files in.
+type appDirs struct {
+	// Name of the application's subdirectory in each
+	// directory. If it's empty there isn't one.
+	app string
+	// Operating system, as reported by runtime.GOOS
+	goos string
+	// Returns the value of an environment variable, like os.Getenv
+	getenv func(key string) string
+}
+
+// newAppDirs returns the directories for the application
+// named app on this system.
+func newAppDirs(app string) *appDirs {
+	return &appDirs{app: app, goos: runtime.GOOS, getenv: os.Getenv}
+}
+
+// Dir returns the directory for files of the given kind.
+// It doesn't create it.
+func (d *appDirs) Dir(kind dirKind) (string, error) {
+	switch d.goos {
 	case "windows":
-		return os.Getenv("%APPDATA%"), system
-	case "darwin":
-		u, _ := user.Current()
-		return filepath.Join(u.Username, u.HomeDir, "Library", "Preferences"), system
-	case "linux":
-		return os.Getenv("HOME"), system
+		return d.windowsDir(kind)
+	case "darwin", "ios":
+		home, err := d.home("HOME")
+		if err != nil {
+			return "", err
+		}
+		switch kind {
+		case configDir:
+			return d.join(home, "Library", "Application Support", d.app), nil
+		case cacheDir:
+			return d.join(home, "Library", "Caches", d.app), nil
+		case dataDir:
+			return d.join(home, "Library", "Application Support", d.app, "Data"), nil
+		case stateDir:
+			return d.join(home, "Library", "Application Support", d.app, "State"), nil
+		}
+		return "", fmt.Errorf("unknown kind of directory %v", kind)
+	case "plan9":
+		home, err := d.home("home")
+		if err != nil {
+			return "", err
+		}
+		if kind == configDir {
+			return d.join(home, "lib", d.app), nil
+		}
+		return d.join(home, "lib", d.app, kind.String()), nil
+	}
+	return d.xdgDir(kind)
+}
+
+// Create returns the directory for files of the given kind,
+// creating it if need be. Only the user can use it.
+func (d *appDirs) Create(kind dirKind) (string, error) {
+	dir, err := d.Dir(kind)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// xdgDir follows the XDG Base Directory specification:
+// https://specifications.freedesktop.org/basedir-spec/latest/
+func (d *appDirs) xdgDir(kind dirKind) (string, error) {
+	var env string
+	var fallback []string
+	switch kind {
+	case configDir:
+		env, fallback = "XDG_CONFIG_HOME", []string{".config"}
+	case cacheDir:
+		env, fallback = "XDG_CACHE_HOME", []string{".cache"}
+	case dataDir:
+		env, fallback = "XDG_DATA_HOME", []string{".local", "share"}
+	case stateDir:
+		env, fallback = "XDG_STATE_HOME", []string{".local", "state"}
 	default:
-		return os.Getenv("HOME"), system
+		return "", fmt.Errorf("unknown kind of directory %v", kind)
+	}
+	// The spec says to ignore relative paths.
+	if dir := d.getenv(env); path.IsAbs(dir) {
+		return d.join(dir, d.app), nil
+	}
+	home, err := d.home("HOME")
+	if err != nil {
+		return "", err
+	}
+	return d.join(append(append([]string{home}, fallback...), d.app)...), nil
+}
+
+// windowsDir puts config in the roaming application data
+// directory and everything else in the local one, with
+// the application's data, cache and state kept apart.
+func (d *appDirs) windowsDir(kind dirKind) (string, error) {
+	env, under := "LOCALAPPDATA", []string{"AppData", "Local"}
+	if kind == configDir {
+		env, under = "APPDATA", []string{"AppData", "Roaming"}
+	}
+	base := d.getenv(env)
+	if base == "" {
+		home, err := d.home("USERPROFILE")
+		if err != nil {
+			return "", fmt.Errorf("%%%s%% isn't set: %w", env, err)
+		}
+		base = d.join(append([]string{home}, under...)...)
+	}
+	switch kind {
+	case configDir:
+		return d.join(base, d.app), nil
+	case cacheDir:
+		return d.join(base, d.app, "Cache"), nil
+	case dataDir:
+		return d.join(base, d.app, "Data"), nil
+	case stateDir:
+		return d.join(base, d.app, "State"), nil
+	}
+	return "", fmt.Errorf("unknown kind of directory %v", kind)
+}
+
+// home returns the user's home directory from the
+// environment variable env.
+func (d *appDirs) home(env string) (string, error) {
+	if home := d.getenv(env); home != "" {
+		return home, nil
+	}
+	return "", fmt.Errorf("unable to find home directory: $%s isn't set", env)
+}
+
+// join joins path elements with the separator for d.goos,
+// which may not be the one for the system this runs on.
+// Empty elements are left out.
+func (d *appDirs) join(elem ...string) string {
+	if d.goos != "windows" {
+		return path.Join(elem...)
+	}
+	var parts []string
+	for i, e := range elem {
+		if i > 0 {
+			e = strings.TrimLeft(e, `\/`)
+		}
+		if e = strings.TrimRight(e, `\/`); e != "" {
+			parts = append(parts, e)
+		}
+	}
+	return strings.Join(parts, `\`)
+}
+
+// suggestCfgDir() returns the recommended location of the directory
+// that stores user configuration data, without an application
+// subdirectory, in the dir variable, and the OS it detected in the
+// system variable. dir is empty if it can't be determined.
+func suggestCfgDir() (dir, system string) {
+	dir, _ = newAppDirs("").Dir(configDir)
+	return dir, runtime.GOOS
+}
+
+// fakeEnv returns a getenv function for an environment with the
+// variables given as name/value pairs.
+func fakeEnv(pairs ...string) func(string) string {
+	return func(key string) string {
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if pairs[i] == key {
+				return pairs[i+1]
+			}
+		}
+		return ""
 	}
 }
 
 func main() {
-	configDir, opsys := suggestCfgDir()
-	fmt.Printf("Suggested place to store config files on %s: %s\n", opsys, configDir)
+	dir, opsys := suggestCfgDir()
+	fmt.Printf("Suggested place to store config files on %s: %s\n", opsys, dir)
+
+	kinds := []dirKind{configDir, cacheDir, dataDir, stateDir}
+	show := func(d *appDirs) {
+		fmt.Printf("\n%s:\n", d.goos)
+		for _, kind := range kinds {
+			dir, err := d.Dir(kind)
+			if err != nil {
+				fmt.Printf("  %-6s %v\n", kind, err)
+				continue
+			}
+			fmt.Printf("  %-6s %s\n", kind, dir)
+		}
+	}
+	show(newAppDirs("microcms"))
+
+	// The same application on other systems
+	show(&appDirs{app: "microcms", goos: "windows", getenv: fakeEnv(
+		"APPDATA", `C:\Users\tom\AppData\Roaming`,
+		"LOCALAPPDATA", `C:\Users\tom\AppData\Local`)})
+	show(&appDirs{app: "microcms", goos: "darwin", getenv: fakeEnv("HOME", "/Users/tom")})
+	show(&appDirs{app: "microcms", goos: "linux", getenv: fakeEnv(
+		"HOME", "/home/tom",
+		"XDG_CONFIG_HOME", "/home/tom/dotfiles",
+		// Relative, so it's ignored
+		"XDG_CACHE_HOME", "tmp/cache")})
+	show(&appDirs{app: "microcms", goos: "linux", getenv: fakeEnv()})
 }
@@ -0,0 +1,440 @@
+// tomledit.go edits a TOML file in place. Decoding a TOML file
+// into a map and encoding it again loses comments, blank lines and
+// key order, and os.Create truncates the file before the new
+// contents are written. tomlDocument instead edits the lines of the
+// file, leaving everything it doesn't change alone. editTOMLFile
+// takes a lock so only one process edits the file at a time, and
+// replaces it all at once.
+//
+// There's no main function here. Build this file along with a
+// program that uses it, such as multiconfig.go or tomlperplatform.go:
+//
+//	go run multiconfig.go tomledit.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait for another process to finish editing
+const lockTimeout = 10 * time.Second
+
+// A lock file that hasn't been touched for this long was left
+// behind by a process that stopped before it could remove it.
+// The process holding a lock touches it more often than this.
+const staleLockAge = time.Minute
+
+// tomlDocument is the text of a TOML file, line by line.
+type tomlDocument struct {
+	lines []string
+}
+
+// tomlStatement is a table header or key/value pair, which
+// may continue over several lines, or a blank or comment line.
+type tomlStatement struct {
+	// First and last lines
+	start, end int
+	// Set for [table] and [[array of tables]] headers
+	header bool
+	array  bool
+	// The table it's in, or for a header the one it starts.
+	// "" is the top level.
+	table string
+	// Set for key/value pairs
+	key string
+	// Comment at the end of the last line, if any
+	comment string
+}
+
+// parseTOMLDocument splits src into lines.
+func parseTOMLDocument(src string) *tomlDocument {
+	src = strings.TrimSuffix(src, "\n")
+	if src == "" {
+		return &tomlDocument{}
+	}
+	return &tomlDocument{lines: strings.Split(src, "\n")}
+}
+
+// String returns the document's text.
+func (d *tomlDocument) String() string {
+	if len(d.lines) == 0 {
+		return ""
+	}
+	return strings.Join(d.lines, "\n") + "\n"
+}
+
+// statements returns every statement in the document.
+func (d *tomlDocument) statements() (stmts []tomlStatement) {
+	table := ""
+	for i := 0; i < len(d.lines); i++ {
+		s := tomlStatement{start: i, table: table}
+		line := strings.TrimSpace(d.lines[i])
+		switch {
+		case line == "" || line[0] == '#':
+			s.end = i
+			stmts = append(stmts, s)
+			continue
+		case line[0] == '[':
+			s.header = true
+			s.array = strings.HasPrefix(line, "[[")
+			name := strings.TrimPrefix(line, "[")
+			if s.array {
+				name = strings.TrimPrefix(name, "[")
+			}
+			// The name ends at the first ] that isn't quoted.
+			end := tomlScan(name, 0, func(j int) bool { return name[j] == ']' })
+			s.table = tomlKey(name[:end])
+			table = s.table
+			// Carry on after the closing ] or ]].
+			lead := len(d.lines[i]) - len(strings.TrimLeft(d.lines[i], " \t"))
+			col := lead + len(line) - len(name) + end
+			s.end, s.comment = d.scanValue(i, col)
+		default:
+			eq := tomlScan(d.lines[i], 0, func(j int) bool { return d.lines[i][j] == '=' })
+			s.key = tomlKey(d.lines[i][:eq])
+			s.end, s.comment = d.scanValue(i, eq+1)
+		}
+		stmts = append(stmts, s)
+		i = s.end
+	}
+	return stmts
+}
+
+// scanValue finds where a statement that starts on line i ends,
+// starting at column col. A value ends with its line unless it's a
+// multi-line string, or an array or inline table that hasn't been
+// closed. Returns the last line of the statement and its comment.
+func (d *tomlDocument) scanValue(i, col int) (end int, comment string) {
+	depth := 0
+	// The delimiter of a multi-line string being read, if any
+	multi := ""
+	for end = i; end < len(d.lines); end, col = end+1, 0 {
+		line := d.lines[end]
+		comment = ""
+	scan:
+		for j := col; j < len(line); j++ {
+			if multi != "" {
+				if multi == `"""` && line[j] == '\\' {
+					j++
+				} else if strings.HasPrefix(line[j:], multi) {
+					j += 2
+					multi = ""
+				}
+				continue
+			}
+			switch c := line[j]; {
+			case c == '#':
+				// Arrays can have comments inside them.
+				comment = line[j:]
+				break scan
+			case strings.HasPrefix(line[j:], `"""`), strings.HasPrefix(line[j:], `'''`):
+				multi = line[j : j+3]
+				j += 2
+			case c == '"' || c == '\'':
+				j = tomlStringEnd(line, j)
+			case c == '[' || c == '{':
+				depth++
+			case c == ']' || c == '}':
+				depth--
+			}
+		}
+		if multi == "" && depth <= 0 {
+			return end, comment
+		}
+	}
+	return len(d.lines) - 1, ""
+}
+
+// tomlScan returns the index of the first byte in s, from
+// start on, that isn't in a quoted string and for which
+// found returns true, or len(s) if there isn't one.
+func tomlScan(s string, start int, found func(j int) bool) int {
+	for j := start; j < len(s); j++ {
+		if s[j] == '"' || s[j] == '\'' {
+			j = tomlStringEnd(s, j)
+			continue
+		}
+		if found(j) {
+			return j
+		}
+	}
+	return len(s)
+}
+
+// tomlStringEnd returns the index of the quote that ends the
+// single-line string starting with the quote at s[start].
+func tomlStringEnd(s string, start int) int {
+	quote := s[start]
+	for j := start + 1; j < len(s); j++ {
+		if quote == '"' && s[j] == '\\' {
+			j++
+		} else if s[j] == quote {
+			return j
+		}
+	}
+	return len(s)
+}
+
+// tomlKey returns a key or table name in a standard form, so
+// [ darwin . "PlatformSpecific" ] is darwin.PlatformSpecific.
+func tomlKey(s string) string {
+	var parts []string
+	for {
+		dot := tomlScan(s, 0, func(j int) bool { return s[j] == '.' })
+		part := strings.TrimSpace(s[:dot])
+		if len(part) >= 2 && (part[0] == '"' || part[0] == '\'') {
+			if unquoted, err := strconv.Unquote(`"` + part[1:len(part)-1] + `"`); err == nil && part[0] == '"' {
+				part = unquoted
+			} else {
+				part = part[1 : len(part)-1]
+			}
+		}
+		parts = append(parts, part)
+		if dot == len(s) {
+			return strings.Join(parts, ".")
+		}
+		s = s[dot+1:]
+	}
+}
+
+// HasTable returns true if the document has a header for table.
+func (d *tomlDocument) HasTable(table string) bool {
+	for _, s := range d.statements() {
+		if s.header && s.table == table {
+			return true
+		}
+	}
+	return false
+}
+
+// Set gives key the value in table, which is a dotted name such as
+// darwin.PlatformSpecific, or "" for the top level. If the key is
+// already there its value is replaced, keeping any comment after it.
+// Otherwise it's added after the table's last key, indented like
+// that key. If there's no such table it's added at the end.
+func (d *tomlDocument) Set(table, key string, value interface{}) error {
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(map[string]interface{}{key: value}); err != nil {
+		return err
+	}
+	kv := strings.TrimSuffix(b.String(), "\n")
+	if strings.Contains(kv, "\n") {
+		return fmt.Errorf("%s: can only set single values, not %v", key, value)
+	}
+
+	stmts := d.statements()
+	// Where the table's header ends, and its last key/value
+	header, last := -1, -1
+	found := table == ""
+	for _, s := range stmts {
+		if s.header {
+			if s.table == table {
+				if s.array {
+					return fmt.Errorf("[[%s]] is an array of tables", table)
+				}
+				header, found = s.end, true
+			}
+			continue
+		}
+		if s.key == "" || s.table != table {
+			continue
+		}
+		if s.key == key {
+			indent := d.lines[s.start][:len(d.lines[s.start])-len(strings.TrimLeft(d.lines[s.start], " \t"))]
+			line := indent + kv
+			if s.comment != "" {
+				line += " " + s.comment
+			}
+			d.replace(s.start, s.end, line)
+			return nil
+		}
+		last = s.end
+	}
+
+	if !found {
+		if len(d.lines) > 0 && strings.TrimSpace(d.lines[len(d.lines)-1]) != "" {
+			d.lines = append(d.lines, "")
+		}
+		d.lines = append(d.lines, "["+tomlTableName(table)+"]", "  "+kv)
+		return nil
+	}
+	indent := ""
+	switch {
+	case last >= 0:
+		// After the table's last key, indented the same way
+		for _, s := range stmts {
+			if s.end == last {
+				line := d.lines[s.start]
+				indent = line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+			}
+		}
+	case table != "":
+		// Right after the header
+		last, indent = header, "  "
+	default:
+		// Top-level keys have to come before the first table,
+		// and before any comments about that table.
+		last = len(d.lines) - 1
+		for _, s := range stmts {
+			if s.header {
+				last = s.start - 1
+				break
+			}
+		}
+		for last >= 0 && strings.HasPrefix(strings.TrimSpace(d.lines[last]), "#") {
+			last--
+		}
+	}
+	d.replace(last+1, last, indent+kv)
+	return nil
+}
+
+// replace replaces lines start through end with line. If
+// end is before start, line is inserted before start.
+func (d *tomlDocument) replace(start, end int, line string) {
+	lines := append([]string{}, d.lines[:start]...)
+	lines = append(lines, line)
+	d.lines = append(lines, d.lines[end+1:]...)
+}
+
+// tomlTableName returns table as it's written in a header,
+// quoting any parts that aren't bare keys.
+func tomlTableName(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		if part == "" || strings.IndexFunc(part, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+		}) >= 0 {
+			parts[i] = strconv.Quote(part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// editTOMLFile reads the TOML file filename, or starts with
+// an empty one if it doesn't exist, and passes it to edit.
+// If edit returns nil and the result is valid TOML, it
+// replaces filename. Other processes using editTOMLFile
+// wait until it's done.
+func editTOMLFile(filename string, edit func(doc *tomlDocument) error) (err error) {
+	unlock, err := lockFile(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+
+	src, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var check map[string]interface{}
+	if _, err := toml.Decode(string(src), &check); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	doc := parseTOMLDocument(string(src))
+	if err := edit(doc); err != nil {
+		return err
+	}
+	edited := doc.String()
+	if edited == string(src) {
+		return nil
+	}
+	// Don't replace a good file with a broken one.
+	if _, err := toml.Decode(edited, &check); err != nil {
+		return fmt.Errorf("%s: editing it would make it invalid: %w", filename, err)
+	}
+	return writeFileAtomic(filename, []byte(edited))
+}
+
+// writeFileAtomic replaces filename with contents by writing
+// a temporary file in the same directory and renaming it, so
+// nobody ever sees a partly written file.
+func writeFileAtomic(filename string, contents []byte) (err error) {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(contents); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// lockFile takes an advisory lock on filename by creating
+// filename.lock, which only one process can do at a time.
+// It waits up to lockTimeout for another process to remove
+// it, and removes it itself if it's older than staleLockAge.
+// While the lock is held its modification time is refreshed,
+// so a long edit isn't mistaken for a stale lock. The returned
+// function releases the lock.
+func lockFile(filename string) (unlock func() error, err error) {
+	lock := filename + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			// Say who has it, in case it's left behind.
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			done := make(chan struct{})
+			go func() {
+				ticker := time.NewTicker(staleLockAge / 4)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case now := <-ticker.C:
+						os.Chtimes(lock, now, now)
+					}
+				}
+			}()
+			return func() error {
+				close(done)
+				return os.Remove(lock)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is locked by another process. If it isn't running, remove %s", filename, lock)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -4,45 +4,21 @@ https://play.golang.org/p/LgZwOT363sZ
 [darwin]
   home = "/users/tom"
   version = "0.5.1"
+
+The file is written and read by configcodec.go, which
+goes by the extension, so app.yaml or app.json would
+work just as well. Run it like this:
+
+go run tomlgen.go configcodec.go
 */
 package main
 
 import (
 	"fmt"
-	"github.com/BurntSushi/toml"
-	"io/ioutil"
-	"os"
 )
 
-// writeMapFile() creates a TOML file based on the filename and
-// map passed in.
-func writeMapFile(filename string, target interface{}) error {
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	if err = toml.NewEncoder(f).Encode(target); err != nil {
-		return err
-	}
-	if err := f.Close(); err != nil {
-		return err
-	}
-	return nil
-}
-
-func readMapFile(filename string, target interface{}) (err error) {
-	var input []byte
-	if input, err = ioutil.ReadFile(filename); err != nil {
-		return err
-	}
-	if _, err = toml.Decode(string(input), target); err != nil {
-		return err
-	}
-	return nil
-}
-
 func main() {
-	const cfgFilename = "app.cfg"
+	const cfgFilename = "app.toml"
 	var Config map[string]map[string]string
 	Config = make(map[string]map[string]string)
 	kv := make(map[string]string)
@@ -51,10 +27,10 @@ func main() {
 	kv["version"] = "0.5.1"
 	Config["darwin"] = kv
 
-	if err := writeMapFile(cfgFilename, &Config); err != nil {
+	if err := writeConfig(cfgFilename, &Config); err != nil {
 		panic(err.Error())
 	}
-	if err := readMapFile(cfgFilename, &Config); err != nil {
+	if _, err := readConfig(cfgFilename, &Config); err != nil {
 		panic(err.Error())
 	}
 	fmt.Printf("Contents of %s:\n%+v\n", cfgFilename, Config)
@@ -17,6 +17,13 @@
 
   Uses the go-homedir package as an example of platform-specific config.
 
+  The file is edited in place rather than decoded and encoded again,
+  so comments, blank lines and the order of keys survive, and it's
+  locked while being edited. That's done by tomledit.go,
+  so build it along with this file:
+
+    go run tomlperplatform.go tomledit.go
+
   https://play.golang.org/p/FXrGXgrXABN
 */
 package main
@@ -54,23 +61,6 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
-// writeMapFile() creates a TOML file based on the filename and
-// map passed in. This works unchanged with any TOML-compatible
-// data structure.
-func writeMapFile(filename string, target interface{}) error {
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	if err = toml.NewEncoder(f).Encode(target); err != nil {
-		return err
-	}
-	if err := f.Close(); err != nil {
-		return err
-	}
-	return nil
-}
-
 // readMapFile() opens the TOML file, reads the contents
 // of any TOML-compatible data structure, and marshals
 // them into the data structure whose address has been
@@ -113,33 +103,28 @@ func main() {
 	// Is there already a config file?
 	if fileExists(appCfgFilename) {
 		fmt.Println(appCfgFilename, "exists. Now reading it in.")
-		// Yes. Read it in. May be for a different OS.
-		if err := readMapFile(appCfgFilename, &App); err != nil {
-			panic(err.Error())
-		}
 	} else {
 		fmt.Println(appCfgFilename, "doesn't exist yet. Now creating it.")
 	}
-	// See what existing config there is for this OS, if any.
-	_, ok := App[OS]
-	if !ok {
-		// Not found, so create an entry for it.
-		var c Config
-		c.PlatformSpecific = make(map[string]string)
-		c.PlatformSpecific["home"] = homeDir()
-		App[OS] = c
-	}
-
-	// Create a TOML file with the current configuration.
-	// If there was a previous configuration for a different
-	// OS, it's preserved.
-	if err := writeMapFile(appCfgFilename, &App); err != nil {
-		panic(err.Error())
+	// If there's no entry for this OS, create one. Whatever
+	// else is in the file, including entries for other
+	// operating systems and comments, is preserved.
+	table := OS + ".PlatformSpecific"
+	err := editTOMLFile(appCfgFilename, func(doc *tomlDocument) error {
+		if doc.HasTable(table) {
+			return nil
+		}
+		return doc.Set(table, "home", homeDir())
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	// Just to be sure, read back TOML file and display its contents.
 	if err := readMapFile(appCfgFilename, &App); err != nil {
-		panic(err.Error())
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	fmt.Printf("Home dir on %s: %s\n",
@@ -1,11 +1,10 @@
-// Write contents of struct to YAML file. Read YAML file back into a struct. Uses gopkg.in/yaml 
+// Write contents of struct to YAML file. Read YAML file back into a struct. Uses gopkg.in/yaml
+// by way of configcodec.go, so run it like this:
+//   go run yamlreadwritestruct.go configcodec.go
 package main
 
 import (
 	"fmt"
-	"io/ioutil"
-	"gopkg.in/yaml.v3"
-  "os"
 )
 
 type Theme struct {
@@ -20,12 +19,7 @@ func main() {
 			Branding:    "Debut by Metabuzz",
 			Description: "Perfect theme to showcase a new product"}
 
-	b, err := yaml.Marshal(&theme)
-	if err != nil {
-		panic(err)
-	}
-
-	err = ioutil.WriteFile(filename, b, os.ModePerm)
+	err := writeConfig(filename, &theme)
 	if err != nil {
 		panic(err)
 	}
@@ -39,17 +33,12 @@ description: Perfect theme to showcase a new product
 
 */
 
-	b, err = ioutil.ReadFile(filename)
-	if err != nil {
-		panic(err)
-	}
-	fmt.Printf("Read file %v\n", filename)
-
   var t Theme
-	err = yaml.Unmarshal(b, &t)
+	_, err = readConfig(filename, &t)
 	if err != nil {
 		panic(err)
 	}
+	fmt.Printf("Read file %v\n", filename)
 
   fmt.Printf("File contents: %#v\n", t)
 